@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+//cap branch              list branches, marking the current one
+//cap branch <name> [<start>]
+//                        create a branch at the current commit, or at
+//                        the revision start
+//cap branch -d <name>    delete a branch
+func branch() {
+	flags := flag.NewFlagSet("branch", flag.ExitOnError)
+	del := flags.Bool("d", false, "delete the named branch")
+	parseFlags(flags, os.Args[2:])
+
+	switch {
+	case *del:
+		if flags.NArg() != 1 {
+			log.Fatal("usage: cap branch -d <name>")
+		}
+		deleteBranch(flags.Arg(0))
+	case flags.NArg() == 0:
+		listBranches()
+	case flags.NArg() <= 2:
+		createBranch(flags.Arg(0), flags.Arg(1))
+	default:
+		log.Fatal("usage: cap branch [-d] [<name> [<start>]]")
+	}
+}
+
+func listBranches() {
+	names, err := listRefs("refs/heads")
+	checkError(err)
+	current, _ := currentBranch()
+	if commit, err := readCurrentCommit(); err == nil && commit == "" && current != "" {
+		fmt.Printf("* %s (no commits yet)\n", current)
+	}
+	for _, name := range names {
+		marker := " "
+		if name == current {
+			marker = "*"
+		}
+		fmt.Println(marker, name)
+	}
+}
+
+func createBranch(name, start string) {
+	checkError(checkRefName(name))
+	ref := "refs/heads/" + name
+	if refExists(ref) {
+		log.Fatalf("branch %s already exists", name)
+	}
+	if start == "" {
+		start = "HEAD"
+	}
+	commit, err := resolveRevision(start)
+	checkError(err)
+	checkError(writeRef(ref, commit, "branch: created from "+start))
+}
+
+func deleteBranch(name string) {
+	checkError(checkRefName(name))
+	ref := "refs/heads/" + name
+	if !refExists(ref) {
+		log.Fatalf("branch %s does not exist", name)
+	}
+	current, _ := currentBranch()
+	if name == current {
+		log.Fatalf("cannot delete the current branch %s", name)
+	}
+	checkError(os.Remove(filepath.Join(".cap", ref)))
+	checkError(removeReflog(ref))
+}
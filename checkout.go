@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//cap checkout [--force] <branch|revision>
+//1. Work out whether the target is a branch or some other revision
+//2. Refuse to continue if a merge is in progress or local edits would
+//   be lost (unless --force, which also abandons the merge)
+//3. Rewrite the working files to match the target's root tree
+//4. Point HEAD at the branch, or detach it at the commit, and record
+//   the move in HEAD's reflog
+//
+//cap checkout [--force] --orphan <name>
+//Switch to a new, unborn branch; the next commit starts a new history
+//with no parents. The working directory and index are left as they are.
+func checkout() {
+	flags := flag.NewFlagSet("checkout", flag.ExitOnError)
+	force := flags.Bool("force", false, "discard local changes")
+	orphan := flags.Bool("orphan", false, "switch to a new branch with no history")
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() != 1 {
+		log.Fatal("usage: cap checkout [--force] <branch|revision> | --orphan <name>")
+	}
+	target := flags.Arg(0)
+	//The next commit would otherwise record the merge on the new branch
+	if mergeInProgress() && !*force {
+		log.Fatal("a merge is in progress; finish it with `cap commit` or `cap merge --abort` " +
+			"(or use --force to abandon it)")
+	}
+	if *orphan {
+		checkError(checkRefName(target))
+		if refExists("refs/heads/" + target) {
+			log.Fatalf("branch %s already exists", target)
+		}
+		checkError(writeHead("refs/heads/" + target))
+		clearMergeState()
+		return
+	}
+
+	head := "refs/heads/" + target
+	commit, err := readRef(head)
+	if os.IsNotExist(err) {
+		//Not a branch; resolve it as a revision and detach HEAD
+		commit, err = resolveRevision(target)
+		checkError(err)
+		head = commit
+	} else {
+		checkError(err)
+	}
+
+	current, err := readCurrentCommit()
+	checkError(err)
+	from, err := commitFiles(current)
+	checkError(err)
+	to, err := commitFiles(commit)
+	checkError(err)
+
+	if !*force {
+		conflicts, err := checkoutConflicts(from, to)
+		checkError(err)
+		if len(conflicts) > 0 {
+			log.Fatalf("local changes would be overwritten by checkout "+
+				"(use --force to discard them):\n\t%s", strings.Join(conflicts, "\n\t"))
+		}
+	}
+
+	previous, err := readHead()
+	checkError(err)
+	checkError(restoreFiles(from, to))
+	clearMergeState()
+	checkError(writeHead(head))
+	reason := "checkout: moving from " + strings.TrimPrefix(previous, "refs/heads/") + " to " + target
+	checkError(appendReflog(".cap", "HEAD", current, commit, reason))
+}
+
+//Flatten the root tree of a commit, or return no files for an empty ref
+func commitFiles(commit string) (map[string]treeEntry, error) {
+	files := map[string]treeEntry{}
+	if commit == "" {
+		return files, nil
+	}
+	root, err := commitRoot(commit)
+	if err != nil {
+		return nil, err
+	}
+	err = flattenTree(root, "", files)
+	return files, err
+}
+
+//List the paths whose working copy or staged version would be lost by
+//moving from one snapshot to another: tracked files with local edits,
+//staged changes the target doesn't already have, and untracked files
+//the target would overwrite. Files that look as they did when staged
+//are not hashed again.
+func checkoutConflicts(from, to map[string]treeEntry) ([]string, error) {
+	idx, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]bool{}
+	for path := range from {
+		paths[path] = true
+	}
+	for path := range to {
+		paths[path] = true
+	}
+	for path := range idx {
+		paths[path] = true
+	}
+
+	conflicts := []string{}
+	for path := range paths {
+		staged, inIndex := idx[path]
+		stagedEntry := treeEntry{Mode: staged.Mode, Hash: staged.Hash}
+		stagedIn := func(files map[string]treeEntry) bool {
+			entry, ok := files[path]
+			return ok == inIndex && (!ok || sameContent(entry, stagedEntry))
+		}
+		if !stagedIn(from) && !stagedIn(to) {
+			conflicts = append(conflicts, path)
+			continue
+		}
+
+		info, err := os.Lstat(path)
+		if isMissing(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		working := stagedEntry
+		if _, ok := idx.unchanged(path, info); !ok {
+			working, err = hashWorkingFile(path)
+			if isMissing(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if target, ok := to[path]; ok && sameContent(working, target) {
+			continue
+		}
+		if tracked, ok := from[path]; ok && sameContent(working, tracked) {
+			continue
+		}
+		conflicts = append(conflicts, path)
+	}
+	sort.Strings(conflicts)
+	return conflicts, nil
+}
+
+func sameContent(a, b treeEntry) bool {
+	return a.Hash == b.Hash && a.Mode == b.Mode
+}
+
+//Remove files tracked in from but absent from to, then write every
+//file in to into the working directory and stage exactly those files
+func restoreFiles(from, to map[string]treeEntry) error {
+	for path := range from {
+		if _, keep := to[path]; keep {
+			continue
+		}
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removeEmptyParents(path)
+	}
+	for path, entry := range to {
+		err := restoreFile(path, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return resetIndex(to)
+}
+
+//Write a single blob from the object store to path, streaming it so
+//files of any size can be checked out
+func restoreFile(path string, entry treeEntry) error {
+	content, err := openBlob(entry.Hash)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	err = os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	//Clear whatever is there now, so a directory or a symlink doesn't
+	//get in the way
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	switch entry.Mode {
+	case modeSymlink:
+		target, err := ioutil.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(target), path)
+	case modeExecutable:
+		return writeFileFrom(path, content, 0777)
+	default:
+		return writeFileFrom(path, content, 0666)
+	}
+}
+
+func writeFileFrom(path string, r io.Reader, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//Remove directories left empty after deleting path
+func removeEmptyParents(path string) {
+	for dir := filepath.Dir(path); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
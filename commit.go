@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Version of the commit encoding written by encodeCommit. Version 1
+//commits have no author or committer. Versions before 4 record the
+//first parent as "previous" and any others as "merge".
+const commitVersion = 4
+
+//A commit as stored in .cap/objects
+type commitObject struct {
+	Version int
+	Root    string
+	//In order; the first parent is the commit this one was made on top
+	//of, and merges have one more parent per commit merged in
+	Parents   []string
+	Author    identity
+	Committer identity
+	Message   string
+	//When the commit was made, in the committer's timezone
+	Time time.Time
+}
+
+//Commits are stored as text with a fixed field order, so the same commit
+//always encodes to the same bytes (and so the same hash) regardless of
+//Go version or machine:
+//
+//	version 4
+//	root <hash>
+//	parent <hash>        (once per parent, in order)
+//	author <name> <<email>>
+//	committer <name> <<email>>
+//	timestamp <RFC 3339, UTC>
+//	timezone <+hhmm offset the commit was made in>
+//
+//	<message>
+//
+//A commit with no parents has no parent lines. Older versions are
+//encoded as they were written: before version 4 the first parent is a
+//"previous <hash>" line and any others (version 3 only) "merge <hash>"
+//lines, and version 1 commits have no author or committer.
+func encodeCommit(c commitObject) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "version %d\n", c.Version)
+	fmt.Fprintf(&buf, "root %s\n", c.Root)
+	for i, parent := range c.Parents {
+		switch {
+		case c.Version >= 4:
+			fmt.Fprintf(&buf, "parent %s\n", parent)
+		case i == 0:
+			fmt.Fprintf(&buf, "previous %s\n", parent)
+		default:
+			fmt.Fprintf(&buf, "merge %s\n", parent)
+		}
+	}
+	if c.Version >= 2 {
+		fmt.Fprintf(&buf, "author %s\n", c.Author)
+		fmt.Fprintf(&buf, "committer %s\n", c.Committer)
+	}
+	fmt.Fprintf(&buf, "timestamp %s\n", c.Time.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "timezone %s\n", c.Time.Format("-0700"))
+	buf.WriteString("\n")
+	buf.WriteString(c.Message)
+	return buf.Bytes()
+}
+
+//Parse a stored commit, checking that encoding it again reproduces the
+//hash it was stored under
+func decodeCommit(hash string, content []byte) (commitObject, error) {
+	var c commitObject
+	fail := func(problem string) (commitObject, error) {
+		return commitObject{}, fmt.Errorf("commit %s: %s", hash, problem)
+	}
+	end := bytes.Index(content, []byte("\n\n"))
+	if end < 0 {
+		return fail("missing message")
+	}
+	c.Message = string(content[end+2:])
+
+	var timestamp, timezone string
+	for _, line := range strings.Split(string(content[:end]), "\n") {
+		space := strings.IndexByte(line, ' ')
+		if space < 0 {
+			return fail("malformed line " + strconv.Quote(line))
+		}
+		key, value := line[:space], line[space+1:]
+		switch key {
+		case "version":
+			version, err := strconv.Atoi(value)
+			if err != nil {
+				return fail("malformed version")
+			}
+			c.Version = version
+		case "root":
+			c.Root = value
+		case "parent", "previous", "merge":
+			c.Parents = append(c.Parents, value)
+		case "author", "committer":
+			id, err := parseIdentity(value)
+			if err != nil {
+				return fail(err.Error())
+			}
+			if key == "author" {
+				c.Author = id
+			} else {
+				c.Committer = id
+			}
+		case "timestamp":
+			timestamp = value
+		case "timezone":
+			timezone = value
+		default:
+			return fail("unknown field " + key)
+		}
+	}
+	if c.Version < 1 || c.Version > commitVersion {
+		return fail(fmt.Sprintf("unsupported version %d", c.Version))
+	}
+
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return fail("malformed timestamp")
+	}
+	zone, err := time.Parse("-0700", timezone)
+	if err != nil {
+		return fail("malformed timezone")
+	}
+	c.Time = t.In(zone.Location())
+
+	if hashObject(typeCommit, encodeCommit(c)) != hash {
+		return fail("does not re-encode to its hash")
+	}
+	return c, nil
+}
+
+func readCommit(commit string) (commitObject, error) {
+	return readCommitIn(".cap", commit)
+}
+
+//Read and verify a commit from the given .cap directory
+func readCommitIn(capDir, commit string) (commitObject, error) {
+	content, err := readTypedObjectIn(capDir, commit, typeCommit)
+	if err != nil {
+		return commitObject{}, err
+	}
+	return decodeCommit(commit, content)
+}
+
+//Read the root tree hash of a commit
+func commitRoot(commit string) (string, error) {
+	c, err := readCommit(commit)
+	return c.Root, err
+}
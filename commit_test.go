@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeCommit(t *testing.T) {
+	root := strings.Repeat("a", 128)
+	p1, p2, p3 := strings.Repeat("1", 128), strings.Repeat("2", 128), strings.Repeat("3", 128)
+	ada := identity{"Ada Lovelace", "ada@example.com"}
+	bob := identity{"Bob", "bob@example.com"}
+	//14:30 in India is 09:00 UTC; 01:00 in California is 09:00 UTC
+	india := time.Date(2024, 3, 5, 14, 30, 0, 0, time.FixedZone("IST", 5*60*60+30*60))
+	california := time.Date(2024, 3, 5, 1, 0, 0, 0, time.FixedZone("PST", -8*60*60))
+	tests := []struct {
+		name   string
+		commit commitObject
+		want   string
+	}{
+		{"no parents",
+			commitObject{Version: 4, Root: root, Author: ada, Committer: ada, Message: "first\n", Time: california},
+			"version 4\nroot " + root + "\n" +
+				"author Ada Lovelace <ada@example.com>\ncommitter Ada Lovelace <ada@example.com>\n" +
+				"timestamp 2024-03-05T09:00:00Z\ntimezone -0800\n\nfirst\n"},
+		{"one parent",
+			commitObject{Version: 4, Root: root, Parents: []string{p1}, Author: ada, Committer: bob,
+				Message: "second\n\nwith a body", Time: india},
+			"version 4\nroot " + root + "\nparent " + p1 + "\n" +
+				"author Ada Lovelace <ada@example.com>\ncommitter Bob <bob@example.com>\n" +
+				"timestamp 2024-03-05T09:00:00Z\ntimezone +0530\n\nsecond\n\nwith a body"},
+		{"several parents",
+			commitObject{Version: 4, Root: root, Parents: []string{p1, p2, p3}, Author: bob, Committer: bob,
+				Message: "merge\n", Time: india.UTC()},
+			"version 4\nroot " + root + "\nparent " + p1 + "\nparent " + p2 + "\nparent " + p3 + "\n" +
+				"author Bob <bob@example.com>\ncommitter Bob <bob@example.com>\n" +
+				"timestamp 2024-03-05T09:00:00Z\ntimezone +0000\n\nmerge\n"},
+		{"version 3 merge",
+			commitObject{Version: 3, Root: root, Parents: []string{p1, p2}, Author: ada, Committer: ada,
+				Message: "merge\n", Time: india},
+			"version 3\nroot " + root + "\nprevious " + p1 + "\nmerge " + p2 + "\n" +
+				"author Ada Lovelace <ada@example.com>\ncommitter Ada Lovelace <ada@example.com>\n" +
+				"timestamp 2024-03-05T09:00:00Z\ntimezone +0530\n\nmerge\n"},
+		{"version 1",
+			commitObject{Version: 1, Root: root, Parents: []string{p1}, Message: "old\n", Time: california},
+			"version 1\nroot " + root + "\nprevious " + p1 + "\n" +
+				"timestamp 2024-03-05T09:00:00Z\ntimezone -0800\n\nold\n"},
+	}
+	for _, test := range tests {
+		encoded := encodeCommit(test.commit)
+		if string(encoded) != test.want {
+			t.Errorf("%s: encodeCommit =\n%s\nwant\n%s", test.name, encoded, test.want)
+			continue
+		}
+		c, err := decodeCommit(hashObject(typeCommit, encoded), encoded)
+		if err != nil {
+			t.Errorf("%s: decodeCommit: %v", test.name, err)
+			continue
+		}
+		//Only the offset of the timezone is stored, not its name
+		if !c.Time.Equal(test.commit.Time) || c.Time.Format("-0700") != test.commit.Time.Format("-0700") {
+			t.Errorf("%s: decodeCommit gives time %v, want %v", test.name, c.Time, test.commit.Time)
+		}
+		c.Time = test.commit.Time
+		if !reflect.DeepEqual(c, test.commit) {
+			t.Errorf("%s: decodeCommit = %+v, want %+v", test.name, c, test.commit)
+		}
+	}
+}
+
+func TestDecodeCommitRejects(t *testing.T) {
+	v3 := encodeCommit(commitObject{
+		Version: 3,
+		Root:    strings.Repeat("a", 128),
+		Parents: []string{strings.Repeat("1", 128)},
+		Message: "old\n",
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		//Decodes to the same commit, but that encodes with "previous"
+		{"version 3 with a parent line", bytes.Replace(v3, []byte("previous "), []byte("parent "), 1)},
+		{"unsupported version", bytes.Replace(v3, []byte("version 3"), []byte("version 5"), 1)},
+		{"unknown field", bytes.Replace(v3, []byte("previous "), []byte("ancestor "), 1)},
+		{"missing message", bytes.TrimRight(bytes.Split(v3, []byte("\n\n"))[0], "\n")},
+		{"malformed timestamp", bytes.Replace(v3, []byte("2020-01-02T03:04:05Z"), []byte("yesterday"), 1)},
+	}
+	for _, test := range tests {
+		if c, err := decodeCommit(hashObject(typeCommit, test.content), test.content); err == nil {
+			t.Errorf("%s: decodeCommit succeeded with %+v", test.name, c)
+		}
+	}
+	if _, err := decodeCommit(hashObject(typeCommit, v3), v3); err != nil {
+		t.Errorf("decodeCommit of the original version 3 commit: %v", err)
+	}
+	if _, err := decodeCommit(strings.Repeat("0", 128), v3); err == nil {
+		t.Errorf("decodeCommit accepted a commit under the wrong hash")
+	}
+}
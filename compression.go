@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//Codecs objects can be compressed with on disk. core.compression picks
+//the one new objects are written with. Reading recognises the codec
+//from the first bytes of each file, so changing the setting (or
+//upgrading a repository from before compression) leaves every existing
+//object readable. Hashes are always of the uncompressed object.
+type objectCodec struct {
+	name string
+	//Wrap w so that whatever is written through it is compressed
+	compress func(w io.Writer) io.WriteCloser
+}
+
+var objectCodecs = []objectCodec{
+	{"none", func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} }},
+	{"zlib", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+}
+
+const defaultCompression = "zlib"
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func findObjectCodec(name string) (objectCodec, error) {
+	names := []string{}
+	for _, codec := range objectCodecs {
+		if codec.name == name {
+			return codec, nil
+		}
+		names = append(names, codec.name)
+	}
+	return objectCodec{}, fmt.Errorf("unknown core.compression %q (expected one of %s)", name, strings.Join(names, ", "))
+}
+
+//The codec new objects are written with, read once per run
+var localCodec *objectCodec
+
+func objectCompression() (objectCodec, error) {
+	if localCodec != nil {
+		return *localCodec, nil
+	}
+	name, ok, err := configValue("core.compression")
+	if err != nil {
+		return objectCodec{}, err
+	}
+	if !ok {
+		name = defaultCompression
+	}
+	codec, err := findObjectCodec(name)
+	if err != nil {
+		return codec, err
+	}
+	localCodec = &codec
+	return codec, nil
+}
+
+//Wrap a stored object file in a reader giving its uncompressed bytes.
+//Uncompressed objects start with their type name, which can never be
+//mistaken for a zlib header (CM = 8 in the low bits of the first byte,
+//and the first two bytes a multiple of 31).
+func decompressObject(r *bufio.Reader) (io.Reader, error) {
+	magic, _ := r.Peek(2)
+	if len(magic) == 2 && magic[0]&0x0f == 8 && (uint16(magic[0])<<8|uint16(magic[1]))%31 == 0 {
+		return zlib.NewReader(r)
+	}
+	return r, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//Config files hold one "key = value" pair per line, with dotted keys
+//such as user.name. Blank lines and lines starting with # are ignored.
+//Repository settings live in .cap/config and override the user's
+//settings in ~/.capconfig.
+const repoConfigFile = ".cap/config"
+
+func userConfigFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".capconfig"), nil
+}
+
+//Read every key in a config file; a missing file has no keys
+func readConfigFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		key, value, ok, err := parseConfigLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if ok {
+			values[key] = value
+		}
+	}
+	return values, scanner.Err()
+}
+
+//Split a config line into key and value; ok is false for blank lines
+//and comments
+func parseConfigLine(line string) (key, value string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	equals := strings.IndexByte(line, '=')
+	if equals < 0 {
+		return "", "", false, fmt.Errorf("expected key = value")
+	}
+	key = strings.TrimSpace(line[:equals])
+	err = checkConfigKey(key)
+	return key, strings.TrimSpace(line[equals+1:]), err == nil, err
+}
+
+func checkConfigKey(key string) error {
+	parts := strings.Split(key, ".")
+	if len(parts) < 2 {
+		return fmt.Errorf("config key %q must have a section, e.g. user.name", key)
+	}
+	for _, part := range parts {
+		if part == "" || strings.IndexFunc(part, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-')
+		}) >= 0 {
+			return fmt.Errorf("invalid config key %q", key)
+		}
+	}
+	return nil
+}
+
+//Look a key up in the repository config, then the user config
+func configValue(key string) (string, bool, error) {
+	paths := []string{repoConfigFile}
+	if user, err := userConfigFile(); err == nil {
+		paths = append(paths, user)
+	}
+	for _, path := range paths {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return "", false, err
+		}
+		if value, ok := values[key]; ok {
+			return value, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+//Set (or with remove, delete) a key in a config file, leaving every
+//other line as it was
+func writeConfigValue(path, key, value string, remove bool) error {
+	err := checkConfigKey(key)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("config values must be a single line")
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lines := []string{}
+	if len(contents) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	}
+	found := false
+	kept := lines[:0]
+	for _, line := range lines {
+		lineKey, _, ok, _ := parseConfigLine(line)
+		if ok && lineKey == key {
+			if found || remove {
+				continue
+			}
+			found = true
+			line = key + " = " + value
+		}
+		kept = append(kept, line)
+	}
+	if !found && !remove {
+		kept = append(kept, key+" = "+value)
+	}
+	output := strings.Join(kept, "\n")
+	if output != "" {
+		output += "\n"
+	}
+	return ioutil.WriteFile(path, []byte(output), 0666)
+}
+
+//cap config [--global] <key>            print a value
+//cap config [--global] <key> <value>    set a value
+//cap config [--global] --unset <key>    remove a value
+//cap config [--global] --list           print every value
+//Without --global, reads look at the repository then the user config,
+//and writes go to the repository config.
+func config() {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	global := flags.Bool("global", false, "use the user config in ~/.capconfig")
+	unset := flags.Bool("unset", false, "remove the key")
+	list := flags.Bool("list", false, "list every key")
+	parseFlags(flags, os.Args[2:])
+
+	path := repoConfigFile
+	if *global {
+		var err error
+		path, err = userConfigFile()
+		checkError(err)
+	}
+
+	switch {
+	case *list:
+		values := map[string]string{}
+		if !*global {
+			if user, err := userConfigFile(); err == nil {
+				values, err = readConfigFile(user)
+				checkError(err)
+			}
+		}
+		repo, err := readConfigFile(path)
+		checkError(err)
+		for key, value := range repo {
+			values[key] = value
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s=%s\n", key, values[key])
+		}
+	case (*unset || flags.NArg() == 2) && flags.Arg(0) == "core.hash":
+		log.Fatal("core.hash is chosen by `cap create -hash` and can't be changed")
+	case *unset && flags.NArg() == 1:
+		checkError(writeConfigValue(path, flags.Arg(0), "", true))
+	case flags.NArg() == 1:
+		var value string
+		var ok bool
+		var err error
+		if *global {
+			var values map[string]string
+			values, err = readConfigFile(path)
+			value, ok = values[flags.Arg(0)]
+		} else {
+			value, ok, err = configValue(flags.Arg(0))
+		}
+		checkError(err)
+		if !ok {
+			os.Exit(1)
+		}
+		fmt.Println(value)
+	case flags.NArg() == 2:
+		if flags.Arg(0) == "core.compression" {
+			_, err := findObjectCodec(flags.Arg(1))
+			checkError(err)
+		}
+		checkError(writeConfigValue(path, flags.Arg(0), flags.Arg(1), false))
+	default:
+		log.Fatal("usage: cap config [--global] [--list | --unset <key> | <key> [<value>]]")
+	}
+}
+
+//Who made a commit, recorded as "Name <email>"
+type identity struct {
+	Name  string
+	Email string
+}
+
+func (id identity) String() string {
+	return id.Name + " <" + id.Email + ">"
+}
+
+func parseIdentity(s string) (identity, error) {
+	open := strings.LastIndexByte(s, '<')
+	if open < 1 || !strings.HasSuffix(s, ">") || s[open-1] != ' ' {
+		return identity{}, fmt.Errorf("malformed identity %q", s)
+	}
+	return identity{Name: s[:open-1], Email: s[open+1 : len(s)-1]}, nil
+}
+
+//Work out the author or committer identity for a new commit.
+//CAP_<ROLE>_NAME and CAP_<ROLE>_EMAIL (e.g. CAP_AUTHOR_NAME) take
+//precedence over user.name and user.email from config.
+func lookupIdentity(role string) (identity, error) {
+	var id identity
+	fields := []struct {
+		env, key string
+		value    *string
+	}{
+		{"CAP_" + strings.ToUpper(role) + "_NAME", "user.name", &id.Name},
+		{"CAP_" + strings.ToUpper(role) + "_EMAIL", "user.email", &id.Email},
+	}
+	for _, field := range fields {
+		*field.value = os.Getenv(field.env)
+		if *field.value == "" {
+			value, _, err := configValue(field.key)
+			if err != nil {
+				return id, err
+			}
+			*field.value = value
+		}
+		if *field.value == "" {
+			return id, fmt.Errorf("no %s for the %s; set it with `cap config %s <value>` or $%s",
+				field.key, role, field.key, field.env)
+		}
+		if strings.ContainsAny(*field.value, "<>\n") {
+			return id, fmt.Errorf("%s %q may not contain '<', '>' or newlines", field.key, *field.value)
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//A delta rebuilds a target from a base. It starts with the sizes of
+//base and target (uvarints), then a list of ops:
+//
+//	0 <length> <bytes>     insert the given bytes
+//	1 <offset> <length>    copy length bytes of the base from offset
+//
+//with every number a uvarint.
+const (
+	deltaInsert = 0
+	deltaCopy   = 1
+)
+
+//Matches are found by looking up each position of the target in an
+//index of the base's aligned blocks of this many bytes
+const deltaBlock = 16
+
+//Describe target as copies from base plus inserted bytes
+//1. Index every aligned block of the base by a hash of its bytes
+//2. Walk the target looking for blocks the base also has
+//3. Grow each match backwards and forwards as far as the bytes agree,
+//   then copy it, inserting whatever came between matches
+func makeDelta(base, target []byte) []byte {
+	delta := appendUvarint(nil, uint64(len(base)))
+	delta = appendUvarint(delta, uint64(len(target)))
+
+	blocks := map[uint64]int{}
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		key := blockKey(base[i:])
+		if _, ok := blocks[key]; !ok {
+			blocks[key] = i
+		}
+	}
+
+	inserted := 0
+	for i := 0; i+deltaBlock <= len(target); {
+		start, ok := blocks[blockKey(target[i:])]
+		if !ok || !bytes.Equal(base[start:start+deltaBlock], target[i:i+deltaBlock]) {
+			i++
+			continue
+		}
+		from, to := start, i
+		for to > inserted && from > 0 && base[from-1] == target[to-1] {
+			from--
+			to--
+		}
+		end := i + deltaBlock
+		for baseEnd := start + deltaBlock; end < len(target) && baseEnd < len(base) &&
+			base[baseEnd] == target[end]; baseEnd++ {
+			end++
+		}
+		delta = appendDeltaInsert(delta, target[inserted:to])
+		delta = append(delta, deltaCopy)
+		delta = appendUvarint(delta, uint64(from))
+		delta = appendUvarint(delta, uint64(end-to))
+		i, inserted = end, end
+	}
+	return appendDeltaInsert(delta, target[inserted:])
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], n)]...)
+}
+
+func blockKey(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)*0x9e3779b97f4a7c15 ^ binary.LittleEndian.Uint64(b[8:])
+}
+
+func appendDeltaInsert(delta, data []byte) []byte {
+	if len(data) == 0 {
+		return delta
+	}
+	delta = append(delta, deltaInsert)
+	delta = appendUvarint(delta, uint64(len(data)))
+	return append(delta, data...)
+}
+
+var errBadDelta = errors.New("corrupt delta")
+
+//Rebuild the target a delta was made from, given its base
+func applyDelta(base, delta []byte) ([]byte, error) {
+	next := func() (uint64, error) {
+		n, size := binary.Uvarint(delta)
+		if size <= 0 {
+			return 0, errBadDelta
+		}
+		delta = delta[size:]
+		return n, nil
+	}
+	baseSize, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("delta expects a %d byte base, found %d", baseSize, len(base))
+	}
+	//Only objects up to maxDeltaSize are stored as deltas, so anything
+	//bigger is corrupt (and not worth allocating for)
+	targetSize, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if targetSize > maxDeltaSize {
+		return nil, errBadDelta
+	}
+	target := make([]byte, 0, targetSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch op {
+		case deltaInsert:
+			length, err := next()
+			if err != nil || length > uint64(len(delta)) {
+				return nil, errBadDelta
+			}
+			target = append(target, delta[:length]...)
+			delta = delta[length:]
+		case deltaCopy:
+			offset, err := next()
+			if err != nil {
+				return nil, err
+			}
+			length, err := next()
+			if err != nil || offset > uint64(len(base)) || length > uint64(len(base))-offset {
+				return nil, errBadDelta
+			}
+			target = append(target, base[offset:offset+length]...)
+		default:
+			return nil, errBadDelta
+		}
+	}
+	if uint64(len(target)) != targetSize {
+		return nil, errBadDelta
+	}
+	return target, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 40)
+	tests := []struct {
+		name         string
+		base, target string
+		//Whether the delta should come out smaller than the target
+		small bool
+	}{
+		{"both empty", "", "", false},
+		{"empty base", "", "new content\n", false},
+		{"empty target", text, "", true},
+		{"identical", text, text, true},
+		{"shorter than a block", "abc", "abd", false},
+		{"insert in the middle", text, text[:800] + "an inserted line\n" + text[800:], true},
+		{"delete from the middle", text, text[:400] + text[900:], true},
+		{"append", text, text + "one more line\n", true},
+		{"prepend", text, "one more line\n" + text, true},
+		{"moved blocks", text[:880] + "middle\n" + text[880:], text[880:] + "middle\n" + text[:880], true},
+		{"unrelated", "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210", false},
+	}
+	for _, test := range tests {
+		delta := makeDelta([]byte(test.base), []byte(test.target))
+		got, err := applyDelta([]byte(test.base), delta)
+		if err != nil {
+			t.Errorf("%s: applyDelta: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, []byte(test.target)) {
+			t.Errorf("%s: applyDelta rebuilt %q, want %q", test.name, got, test.target)
+		}
+		if test.small && len(delta) >= len(test.target)/2 && len(test.target) > 0 {
+			t.Errorf("%s: delta is %d bytes for a %d byte target", test.name, len(delta), len(test.target))
+		}
+	}
+}
+
+func TestApplyCorruptDelta(t *testing.T) {
+	base := []byte("0123456789")
+	header := appendUvarint(appendUvarint(nil, uint64(len(base))), 4)
+	op := func(b ...uint64) []byte {
+		delta := append([]byte(nil), header...)
+		for _, n := range b {
+			delta = appendUvarint(delta, n)
+		}
+		return delta
+	}
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"empty", nil},
+		{"no target size", appendUvarint(nil, uint64(len(base)))},
+		{"huge target size", append(appendUvarint(appendUvarint(nil, uint64(len(base))), 1<<62), deltaCopy, 0, 4)},
+		{"wrong base size", append(appendUvarint(appendUvarint(nil, 3), 4), deltaCopy, 0, 4)},
+		{"copy past the end of the base", op(deltaCopy, 8, 4)},
+		{"copy offset past the end of the base", op(deltaCopy, 11, 0)},
+		{"insert longer than the delta", append(op(deltaInsert, 4), "ab"...)},
+		{"unknown op", op(7, 0, 4)},
+		{"truncated op", op(deltaCopy, 0)},
+		{"too short", op(deltaCopy, 0, 3)},
+		{"too long", op(deltaCopy, 0, 5)},
+	}
+	for _, test := range tests {
+		if got, err := applyDelta(base, test.delta); err == nil {
+			t.Errorf("%s: applyDelta succeeded with %q", test.name, got)
+		}
+	}
+	if got, err := applyDelta(base, op(deltaCopy, 2, 4)); err != nil || string(got) != "2345" {
+		t.Errorf("applyDelta of a valid copy = %q, %v; want \"2345\"", got, err)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+//One side of a diff: a set of files and a way to read their contents
+type snapshot struct {
+	files map[string]treeEntry
+	read  func(path string, entry treeEntry) ([]byte, error)
+}
+
+func commitSnapshot(commit string) (snapshot, error) {
+	files, err := commitFiles(commit)
+	return snapshot{files, func(path string, entry treeEntry) ([]byte, error) {
+		return readBlob(entry.Hash)
+	}}, err
+}
+
+//The tracked files (staged or in the current commit) as they are on disk
+func workingSnapshot() (snapshot, error) {
+	idx, err := readIndex()
+	if err != nil {
+		return snapshot{}, err
+	}
+	commit, err := readCurrentCommit()
+	if err != nil {
+		return snapshot{}, err
+	}
+	committed, err := commitFiles(commit)
+	if err != nil {
+		return snapshot{}, err
+	}
+	working, err := scanWorkingTree(idx, committed)
+	if err != nil {
+		return snapshot{}, err
+	}
+	files := map[string]treeEntry{}
+	for path, entry := range working {
+		_, staged := idx[path]
+		_, tracked := committed[path]
+		if staged || tracked {
+			files[path] = entry
+		}
+	}
+	return snapshot{files, func(path string, entry treeEntry) ([]byte, error) {
+		_, bytes, _, err := readWorkingFile(path)
+		return bytes, err
+	}}, nil
+}
+
+//A file that differs between two snapshots
+type fileChange struct {
+	Path   string
+	Status byte
+	Old    treeEntry
+	New    treeEntry
+}
+
+//List the files that differ between two snapshots, sorted by path,
+//keeping only those under one of paths (all of them if paths is empty)
+func compareSnapshots(a, b snapshot, paths []string) []fileChange {
+	all := map[string]bool{}
+	for path := range a.files {
+		all[path] = true
+	}
+	for path := range b.files {
+		all[path] = true
+	}
+	changes := []fileChange{}
+	for path := range all {
+		if !matchesPaths(path, paths) {
+			continue
+		}
+		old, inA := a.files[path]
+		current, inB := b.files[path]
+		change := fileChange{Path: path, Old: old, New: current}
+		switch {
+		case !inA:
+			change.Status = statusAdded
+		case !inB:
+			change.Status = statusDeleted
+		case !sameContent(old, current):
+			change.Status = statusModified
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func matchesPaths(path string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, dir := range paths {
+		if underPath(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+//cap diff [-U <lines>] [--stat | --name-status] [<rev> [<rev>]] [[--] <paths>]
+//With no revisions, compares the current commit with the working
+//directory; with one, that commit with the working directory; with two,
+//the first commit with the second.
+//Exits with 0 if there are no differences, 1 if there are and 2 on error.
+func diff() {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	context := flags.Int("U", 3, "lines of context around each change")
+	stat := flags.Bool("stat", false, "summarise the lines changed in each file")
+	nameStatus := flags.Bool("name-status", false, "list changed files with their status")
+	parseFlags(flags, os.Args[2:])
+
+	fail := func(err error) {
+		log.Println("diff:", err)
+		os.Exit(2)
+	}
+	revs, paths, err := splitRevsAndPaths(flags.Args())
+	if err != nil {
+		fail(err)
+	}
+	if len(revs) > 2 {
+		fail(fmt.Errorf("too many revisions"))
+	}
+
+	var a, b snapshot
+	if len(revs) == 0 {
+		var commit string
+		commit, err = readCurrentCommit()
+		if err == nil && commit == "" {
+			//Everything staged shows up as new
+			fmt.Fprintln(os.Stderr, noCommitsYet())
+		}
+		if err == nil {
+			a, err = commitSnapshot(commit)
+		}
+	} else {
+		a, err = commitSnapshot(revs[0])
+	}
+	if err == nil && len(revs) == 2 {
+		b, err = commitSnapshot(revs[1])
+	} else if err == nil {
+		b, err = workingSnapshot()
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	changes := compareSnapshots(a, b, paths)
+	switch {
+	case *nameStatus:
+		for _, change := range changes {
+			fmt.Printf("%c\t%s\n", change.Status, change.Path)
+		}
+	case *stat:
+		err = writeDiffStat(os.Stdout, a, b, changes)
+	default:
+		for _, change := range changes {
+			err = writeFileDiff(os.Stdout, a, b, change, *context)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fail(err)
+	}
+	if len(changes) > 0 {
+		os.Exit(1)
+	}
+}
+
+//Split diff arguments into revisions and path filters. Everything after
+//"--" is a path; before it, leading arguments that name a revision are
+//revisions and the rest must be paths that exist on disk.
+func splitRevsAndPaths(args []string) ([]string, []string, error) {
+	revs := []string{}
+	for i, arg := range args {
+		if arg == "--" {
+			paths, err := cleanPaths(args[i+1:])
+			return revs, paths, err
+		}
+		commit, err := resolveRevision(arg)
+		if err == nil {
+			revs = append(revs, commit)
+			continue
+		}
+		rest := args[i:]
+		for _, path := range rest {
+			if path == "--" {
+				return nil, nil, err
+			}
+			if _, statErr := os.Lstat(path); statErr != nil {
+				return nil, nil, fmt.Errorf("%s is neither a revision nor a path "+
+					"(use -- to separate paths from revisions)", path)
+			}
+		}
+		paths, err := cleanPaths(rest)
+		return revs, paths, err
+	}
+	return revs, nil, nil
+}
+
+func cleanPaths(args []string) ([]string, error) {
+	paths := []string{}
+	for _, arg := range args {
+		path, err := indexPath(arg)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func readChange(a, b snapshot, change fileChange) ([]byte, []byte, error) {
+	var old, current []byte
+	var err error
+	if change.Status != statusAdded {
+		old, err = a.read(change.Path, change.Old)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if change.Status != statusDeleted {
+		current, err = b.read(change.Path, change.New)
+	}
+	return old, current, err
+}
+
+//Write the unified diff of one changed file, with a header describing
+//new and deleted files and mode changes
+func writeFileDiff(w io.Writer, a, b snapshot, change fileChange, context int) error {
+	old, current, err := readChange(a, b, change)
+	if err != nil {
+		return err
+	}
+	nameA, nameB := "a/"+change.Path, "b/"+change.Path
+	fmt.Fprintf(w, "diff --cap %s %s\n", nameA, nameB)
+	switch {
+	case change.Status == statusAdded:
+		fmt.Fprintf(w, "new file mode %s\n", change.New.Mode)
+		nameA = "/dev/null"
+	case change.Status == statusDeleted:
+		fmt.Fprintf(w, "deleted file mode %s\n", change.Old.Mode)
+		nameB = "/dev/null"
+	case change.Old.Mode != change.New.Mode:
+		fmt.Fprintf(w, "old mode %s\nnew mode %s\n", change.Old.Mode, change.New.Mode)
+	}
+	_, err = writeUnifiedDiff(w, nameA, nameB, old, current, context)
+	return err
+}
+
+//Write a --stat summary: lines added and removed per file, and totals
+func writeDiffStat(w io.Writer, a, b snapshot, changes []fileChange) error {
+	type fileStat struct {
+		path           string
+		binary         bool
+		added, deleted int
+	}
+	stats := []fileStat{}
+	width, most := 0, 0
+	totalAdded, totalDeleted := 0, 0
+	for _, change := range changes {
+		old, current, err := readChange(a, b, change)
+		if err != nil {
+			return err
+		}
+		s := fileStat{path: change.Path}
+		if isBinary(old) || isBinary(current) {
+			s.binary = true
+		} else {
+			for _, op := range diffLines(splitLines(old), splitLines(current)) {
+				switch op.Kind {
+				case opInsert:
+					s.added++
+				case opDelete:
+					s.deleted++
+				}
+			}
+		}
+		stats = append(stats, s)
+		if len(s.path) > width {
+			width = len(s.path)
+		}
+		if s.added+s.deleted > most {
+			most = s.added + s.deleted
+		}
+		totalAdded += s.added
+		totalDeleted += s.deleted
+	}
+
+	//Scale the +/- graph so the busiest file fits in 50 columns
+	const graphWidth = 50
+	scale := func(n int) int {
+		if most <= graphWidth || n == 0 {
+			return n
+		}
+		scaled := n * graphWidth / most
+		if scaled == 0 {
+			scaled = 1
+		}
+		return scaled
+	}
+	for _, s := range stats {
+		if s.binary {
+			fmt.Fprintf(w, " %-*s | Bin\n", width, s.path)
+			continue
+		}
+		fmt.Fprintf(w, " %-*s | %d %s%s\n", width, s.path, s.added+s.deleted,
+			strings.Repeat("+", scale(s.added)), strings.Repeat("-", scale(s.deleted)))
+	}
+	_, err := fmt.Fprintf(w, " %d %s changed, %d %s(+), %d %s(-)\n",
+		len(stats), plural(len(stats), "file", "files"),
+		totalAdded, plural(totalAdded, "insertion", "insertions"),
+		totalDeleted, plural(totalDeleted, "deletion", "deletions"))
+	return err
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Something that keeps objects alive: a ref, HEAD, an in-progress
+//merge, a staged file or a reflog entry
+type objectRoot struct {
+	name string
+	hash string
+}
+
+//List every root objects can be reached from, leaving out reflog
+//entries made before reflogCutoff (except the newest of each log, as
+//expireReflogs keeps it). Refs of unborn branches (empty files
+//from older repositories) are left out.
+func objectRoots(reflogCutoff time.Time) ([]objectRoot, error) {
+	roots := []objectRoot{}
+	refs, err := listRefs("refs")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range refs {
+		ref := "refs/" + name
+		hash, err := readRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		if hash != "" {
+			roots = append(roots, objectRoot{ref, hash})
+		}
+	}
+	head, err := readHead()
+	if err != nil {
+		return nil, err
+	}
+	if isDetached(head) {
+		roots = append(roots, objectRoot{"HEAD", head})
+	}
+	if mergeInProgress() {
+		mergeHead, err := readMergeHead()
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, objectRoot{"MERGE_HEAD", mergeHead})
+	}
+	idx, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	for path, entry := range idx {
+		roots = append(roots, objectRoot{"index entry " + path, entry.Hash})
+	}
+	logs, err := listReflogs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range logs {
+		entries, err := readReflog(ref)
+		if err != nil {
+			return nil, err
+		}
+		for i, entry := range entries {
+			if entry.New != "" && (i == len(entries)-1 || !entry.Time.Before(reflogCutoff)) {
+				name := fmt.Sprintf("reflog entry %s@{%d}", ref, len(entries)-1-i)
+				roots = append(roots, objectRoot{name, entry.New})
+			}
+		}
+	}
+	return roots, nil
+}
+
+//An object one object refers to, and what it should be
+type objectLink struct {
+	hash string
+	kind string
+	role string
+}
+
+//Work out which objects an object refers to, checking its content
+//parses as its type says it should
+func objectLinks(hash, kind string, content []byte) ([]objectLink, error) {
+	switch kind {
+	case typeBlob:
+		return nil, nil
+	case typeTree:
+		var entries []treeEntry
+		err := json.Unmarshal(content, &entries)
+		if err != nil {
+			return nil, fmt.Errorf("tree %s: %v", hash, err)
+		}
+		links := []objectLink{}
+		for _, entry := range entries {
+			switch entry.Mode {
+			case modeTree:
+				links = append(links, objectLink{entry.Hash, typeTree, "tree " + entry.Name})
+			case modeFile, modeExecutable, modeSymlink:
+				links = append(links, objectLink{entry.Hash, typeBlob, "blob " + entry.Name})
+			default:
+				return nil, fmt.Errorf("tree %s: %s has unknown mode %s", hash, entry.Name, entry.Mode)
+			}
+		}
+		return links, nil
+	case typeCommit:
+		c, err := decodeCommit(hash, content)
+		if err != nil {
+			return nil, err
+		}
+		links := []objectLink{{c.Root, typeTree, "root tree"}}
+		for _, parent := range c.Parents {
+			links = append(links, objectLink{parent, typeCommit, "parent"})
+		}
+		return links, nil
+	case typeTag:
+		t, err := decodeTag(hash, content)
+		if err != nil {
+			return nil, err
+		}
+		return []objectLink{{t.Object, t.Type, "tagged " + t.Type}}, nil
+	}
+	return nil, fmt.Errorf("object %s: unknown type %q", hash, kind)
+}
+
+//Read an object through, checking it against its size and name. Blobs
+//link to nothing, so they are streamed rather than loaded, however
+//large, and come back without their content.
+func checkObject(hash string) (string, []byte, error) {
+	kind, _, r, err := openObjectIn(".cap", hash)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	if kind == typeBlob {
+		_, err = io.Copy(ioutil.Discard, r)
+		return kind, nil, err
+	}
+	content, err := ioutil.ReadAll(r)
+	return kind, content, err
+}
+
+//Find a name used by more than one entry of a tree, as staging a
+//directory where a file used to be once could make
+func duplicateTreeEntry(kind string, content []byte) (string, bool) {
+	var entries []treeEntry
+	if kind != typeTree || json.Unmarshal(content, &entries) != nil {
+		return "", false
+	}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if seen[entry.Name] {
+			return entry.Name, true
+		}
+		seen[entry.Name] = true
+	}
+	return "", false
+}
+
+//cap fsck
+//1. Rehash every object, loose or packed, and check it parses (and
+//   that no tree has two entries with the same name)
+//2. Check every ref (and HEAD, MERGE_HEAD, the index and the reflogs)
+//   names an object of the right type
+//3. Walk everything reachable from those, reporting missing objects
+//4. List dangling objects: unreachable ones no other object refers to
+//Exits 1 if anything is corrupt or missing. Dangling objects are left
+//behind by normal use (e.g. a branch deleted before merging), so they
+//are reported but don't count as problems.
+func fsck() {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() != 0 {
+		log.Fatal("usage: cap fsck")
+	}
+	problems := 0
+	report := func(format string, args ...interface{}) {
+		problems++
+		fmt.Printf(format+"\n", args...)
+	}
+
+	hashes, err := listObjects(".cap")
+	checkError(err)
+	kinds := map[string]string{}
+	corrupt := map[string]bool{}
+	links := map[string][]objectLink{}
+	referenced := map[string]bool{}
+	for _, hash := range hashes {
+		kind, content, err := checkObject(hash)
+		if err == nil {
+			links[hash], err = objectLinks(hash, kind, content)
+		}
+		if err != nil {
+			report("corrupt %v", err)
+			corrupt[hash] = true
+			continue
+		}
+		kinds[hash] = kind
+		if name, ok := duplicateTreeEntry(kind, content); ok {
+			report("tree %s: more than one entry named %s", hash, name)
+		}
+		for _, link := range links[hash] {
+			referenced[link.hash] = true
+		}
+	}
+
+	roots, err := objectRoots(time.Time{})
+	checkError(err)
+	reachable := map[string]bool{}
+	stack := []string{}
+	for _, root := range roots {
+		want := typeCommit
+		switch {
+		case strings.HasPrefix(root.name, "index entry "):
+			want = typeBlob
+		case (strings.HasPrefix(root.name, "refs/tags/") ||
+			strings.HasPrefix(root.name, "reflog entry refs/tags/")) && kinds[root.hash] == typeTag:
+			want = typeTag
+		}
+		switch kind, ok := kinds[root.hash]; {
+		case corrupt[root.hash]:
+		case !ok:
+			report("%s points at missing object %s", root.name, root.hash)
+		case kind != want:
+			report("%s points at a %s, not a %s: %s", root.name, kind, want, root.hash)
+		default:
+			stack = append(stack, root.hash)
+		}
+	}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reachable[hash] {
+			continue
+		}
+		reachable[hash] = true
+		for _, link := range links[hash] {
+			switch kind, ok := kinds[link.hash]; {
+			case corrupt[link.hash]:
+			case !ok:
+				report("%s %s: missing %s %s", kinds[hash], hash, link.role, link.hash)
+			case kind != link.kind:
+				report("%s %s: %s %s is a %s", kinds[hash], hash, link.role, link.hash, kind)
+			default:
+				stack = append(stack, link.hash)
+			}
+		}
+	}
+
+	dangling := []string{}
+	for hash, kind := range kinds {
+		if !reachable[hash] && !referenced[hash] {
+			dangling = append(dangling, "dangling "+kind+" "+hash)
+		}
+	}
+	sort.Strings(dangling)
+	for _, line := range dangling {
+		fmt.Println(line)
+	}
+	if problems > 0 {
+		log.Fatalf("%d %s found", problems, plural(problems, "problem", "problems"))
+	}
+}
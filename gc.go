@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//How long unreachable objects are kept by default, giving commands
+//that have written objects but not yet pointed a ref at them (and
+//anyone wanting to recover a deleted branch) time to finish
+const defaultGCExpiry = "14d"
+
+//How long reflog entries are kept (and keep their commits alive)
+const defaultReflogExpiry = "90d"
+
+//Parse an expiry such as "14d", "36h" or "0" (everything unreachable)
+func parseExpiry(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid expiry %q", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	expiry, err := time.ParseDuration(value)
+	if err != nil || expiry < 0 {
+		return 0, fmt.Errorf("invalid expiry %q (expected e.g. 14d or 36h)", value)
+	}
+	return expiry, nil
+}
+
+//Held by gc while it decides what to delete and deletes it, by repack,
+//and by commands that write objects and then point something at them
+//(commit, merge, tag), so gc never sweeps the objects of a commit that
+//is being made or replaces packs another command is replacing
+func lockObjects() (*refLock, error) {
+	return lockRef(".cap", "gc")
+}
+
+//Mark every object reachable from the given roots. A missing or
+//corrupt object stops the walk: deleting things from a damaged
+//repository could make it worse. Blobs link to nothing, so they are
+//only checked to exist, never read.
+func reachableObjects(roots []objectRoot) (map[string]bool, error) {
+	reachable := map[string]bool{}
+	stack := []objectLink{}
+	for _, root := range roots {
+		link := objectLink{hash: root.hash, role: root.name}
+		if strings.HasPrefix(root.name, "index entry ") {
+			link.kind = typeBlob
+		}
+		stack = append(stack, link)
+	}
+	for len(stack) > 0 {
+		link := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reachable[link.hash] {
+			continue
+		}
+		var err error
+		if link.kind == typeBlob {
+			if !hasObject(".cap", link.hash) {
+				err = fmt.Errorf("%s %s is missing", link.role, link.hash)
+			}
+		} else {
+			var kind string
+			var content []byte
+			kind, content, err = readObject(link.hash)
+			if err == nil {
+				var links []objectLink
+				links, err = objectLinks(link.hash, kind, content)
+				stack = append(stack, links...)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v (run `cap fsck`)", err)
+		}
+		reachable[link.hash] = true
+	}
+	return reachable, nil
+}
+
+//When an object was last written: a loose object's own modification
+//time, or that of the pack holding it
+func objectTime(hash string) (time.Time, error) {
+	info, err := os.Stat(objectPath(".cap", hash))
+	if err == nil {
+		return info.ModTime(), nil
+	}
+	packs, packErr := packsIn(".cap")
+	if packErr != nil {
+		return time.Time{}, packErr
+	}
+	for _, p := range packs {
+		if _, ok := p.objects[hash]; ok {
+			info, err = os.Stat(p.path)
+			break
+		}
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+//cap gc [--dry-run] [--expire <age>]
+//1. Lock out commits for the duration
+//2. Drop reflog entries older than gc.reflogexpire (default 90d)
+//3. Mark everything reachable from refs/heads, refs/tags, refs/remotes,
+//   the remaining reflog entries, a detached HEAD, an unfinished merge
+//   and the index
+//4. Sweep unreachable objects older than gc.expire (default 14d, or
+//   --expire); younger ones are kept, loose, so their age still counts
+//5. Sweep temporary files that interrupted writes left in .cap/objects
+//   and .cap/objects/pack, once untouched for as long
+//6. Repack everything reachable into a single pack
+//--dry-run only lists what would be removed.
+func gc() {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list unreachable objects that would be removed, without removing them")
+	expire := flags.String("expire", "", "remove unreachable objects older than this (e.g. 14d, 36h, 0)")
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() != 0 {
+		log.Fatal("usage: cap gc [--dry-run] [--expire <age>]")
+	}
+	if *expire == "" {
+		*expire = configExpiry("gc.expire", defaultGCExpiry)
+	}
+	expiry, err := parseExpiry(*expire)
+	checkError(err)
+	reflogExpiry, err := parseExpiry(configExpiry("gc.reflogexpire", defaultReflogExpiry))
+	checkError(err)
+
+	lock, err := lockObjects()
+	checkError(err)
+	now := time.Now()
+	err = collectGarbage(now.Add(-expiry), now.Add(-reflogExpiry), *dryRun)
+	lock.abort()
+	checkError(err)
+}
+
+func configExpiry(key, fallback string) string {
+	value, ok, err := configValue(key)
+	checkError(err)
+	if !ok {
+		return fallback
+	}
+	return value
+}
+
+func collectGarbage(cutoff, reflogCutoff time.Time, dryRun bool) error {
+	if !dryRun {
+		dropped, err := expireReflogs(reflogCutoff)
+		if err != nil {
+			return err
+		}
+		if dropped > 0 {
+			fmt.Printf("expired %d reflog %s\n", dropped, plural(dropped, "entry", "entries"))
+		}
+	}
+	roots, err := objectRoots(reflogCutoff)
+	if err != nil {
+		return err
+	}
+	reachable, err := reachableObjects(roots)
+	if err != nil {
+		return err
+	}
+	hashes, err := listObjects(".cap")
+	if err != nil {
+		return err
+	}
+
+	expired, kept := []string{}, []string{}
+	for _, hash := range hashes {
+		if reachable[hash] {
+			continue
+		}
+		written, err := objectTime(hash)
+		if err != nil {
+			return err
+		}
+		if written.Before(cutoff) {
+			expired = append(expired, hash)
+			continue
+		}
+		kept = append(kept, hash)
+		if dryRun || !isPacked(".cap", hash) {
+			continue
+		}
+		//Take young objects out of the pack about to be replaced,
+		//keeping the pack's time so they still expire on schedule
+		err = unpackObject(".cap", hash)
+		if err == nil {
+			err = os.Chtimes(objectPath(".cap", hash), written, written)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	verb, done := "removed", "removed"
+	if dryRun {
+		verb, done = "would remove", "would be removed"
+	}
+	for _, hash := range expired {
+		kind, _, content, err := openObjectIn(".cap", hash)
+		if err != nil {
+			kind = "corrupt object"
+		} else {
+			content.Close()
+		}
+		fmt.Printf("%s %s %s\n", verb, kind, hash)
+		if dryRun {
+			continue
+		}
+		//Packed copies go when the packs are replaced below
+		err = os.Remove(objectPath(".cap", hash))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		//Only succeeds once the directory is empty
+		os.Remove(filepath.Dir(objectPath(".cap", hash)))
+	}
+	fmt.Printf("%d unreachable %s %s, %d kept until they expire\n", len(expired),
+		plural(len(expired), "object", "objects"), done, len(kept))
+
+	temps, err := staleTempFiles(cutoff)
+	if err != nil {
+		return err
+	}
+	for _, path := range temps {
+		fmt.Printf("%s temporary file %s\n", verb, path)
+		if dryRun {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if dryRun {
+		return nil
+	}
+
+	live := make([]string, 0, len(reachable))
+	for hash := range reachable {
+		live = append(live, hash)
+	}
+	sort.Strings(live)
+	packed, deltas, err := packObjects(".cap", live)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("packed %d objects (%d as deltas)\n", packed, deltas)
+	return nil
+}
+
+//List the temporary files of object and pack writes (see
+//writeTempAndRename) that nothing has written to since cutoff, so were
+//left behind by a write that never finished
+func staleTempFiles(cutoff time.Time) ([]string, error) {
+	stale := []string{}
+	for _, dir := range []string{filepath.Join(".cap", "objects"), packDir(".cap")} {
+		temps, err := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range temps {
+			info, err := os.Stat(path)
+			if os.IsNotExist(err) {
+				//Renamed into place since the glob
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if info.ModTime().Before(cutoff) {
+				stale = append(stale, path)
+			}
+		}
+	}
+	return stale, nil
+}
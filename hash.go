@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"path/filepath"
+	"strings"
+
+	"github.com/codahale/blake2"
+)
+
+//Digests objects can be named by. A repository picks one when it is
+//created (cap create -hash <name>) and records it as core.hash in
+//.cap/config; every object in its store is named with that digest.
+type hashAlgorithm struct {
+	name   string
+	config blake2.Config
+}
+
+var hashAlgorithms = []hashAlgorithm{
+	{"blake2b-512", blake2.Config{Size: 64}},
+	//Personalised so cap's object names never collide with plain
+	//BLAKE2b-256 digests of the same bytes used elsewhere
+	{"blake2b-256", blake2.Config{Size: 32, Personal: []byte("cap objects")}},
+}
+
+//Used by new repositories by default, and by repositories created
+//before core.hash existed
+const defaultHash = "blake2b-512"
+
+func findHashAlgorithm(name string) (hashAlgorithm, error) {
+	names := []string{}
+	for _, h := range hashAlgorithms {
+		if h.name == name {
+			return h, nil
+		}
+		names = append(names, h.name)
+	}
+	return hashAlgorithm{}, fmt.Errorf("unknown hash %q (expected one of %s)", name, strings.Join(names, ", "))
+}
+
+func (h hashAlgorithm) new() hash.Hash {
+	config := h.config
+	return blake2.New(&config)
+}
+
+//Length of an object name: the digest in hex
+func (h hashAlgorithm) nameLength() int {
+	return 2 * int(h.config.Size)
+}
+
+//Read the algorithm the repository in capDir names its objects with
+func repoHashIn(capDir string) (hashAlgorithm, error) {
+	values, err := readConfigFile(filepath.Join(capDir, "config"))
+	if err != nil {
+		return hashAlgorithm{}, err
+	}
+	name, ok := values["core.hash"]
+	if !ok {
+		name = defaultHash
+	}
+	h, err := findHashAlgorithm(name)
+	if err != nil {
+		return h, fmt.Errorf("%s: %v", capDir, err)
+	}
+	return h, nil
+}
+
+//The local repository's algorithm, read once per run
+var localHash *hashAlgorithm
+
+func repoHash() hashAlgorithm {
+	if localHash == nil {
+		h, err := repoHashIn(".cap")
+		checkError(err)
+		localHash = &h
+	}
+	return *localHash
+}
+
+//Check that hash could name an object in the local store. Names made
+//with another algorithm (e.g. copied from a repository that uses one)
+//are rejected rather than looked up.
+func checkObjectName(hash string) error {
+	h := repoHash()
+	if len(hash) != h.nameLength() || strings.Trim(hash, "0123456789abcdef") != "" {
+		return fmt.Errorf("%q is not a %s object name", hash, h.name)
+	}
+	return nil
+}
+
+//Refuse to exchange objects with a repository that names them with a
+//different algorithm, since the two stores can't be mixed
+func checkSameHash(capDir string) error {
+	theirs, err := repoHashIn(capDir)
+	if err != nil {
+		return err
+	}
+	if ours := repoHash(); theirs.name != ours.name {
+		return fmt.Errorf("%s uses %s object names but this repository uses %s",
+			filepath.Dir(capDir), theirs.name, ours.name)
+	}
+	return nil
+}
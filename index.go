@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const indexFile = ".cap/index"
+
+//A file staged for the next commit. Size and MTime (in nanoseconds)
+//are what the file looked like on disk when it was staged, so unchanged
+//files can be recognised without hashing them again. Conflict marks a
+//file left with conflicts by a merge that has not been staged since.
+type indexEntry struct {
+	Path     string `json:"path"`
+	Mode     string `json:"mode"`
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	MTime    int64  `json:"mtime"`
+	Conflict bool   `json:"conflict,omitempty"`
+}
+
+//The staging area, keyed by slash-separated path
+type index map[string]indexEntry
+
+//Read .cap/index; a repository with nothing staged has no index file
+func readIndex() (index, error) {
+	idx := index{}
+	contents, err := ioutil.ReadFile(indexFile)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []indexEntry
+	err = json.Unmarshal(contents, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", indexFile, err)
+	}
+	for _, entry := range entries {
+		idx[entry.Path] = entry
+	}
+	return idx, nil
+}
+
+//Write the index sorted by path, replacing the old one atomically
+func writeIndex(idx index) error {
+	entries := make([]indexEntry, 0, len(idx))
+	for _, entry := range idx {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	contents, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(indexFile, contents, 0666)
+}
+
+//The staged snapshot in the form writeTree expects
+func (idx index) files() map[string]treeEntry {
+	files := map[string]treeEntry{}
+	for path, entry := range idx {
+		files[path] = treeEntry{Mode: entry.Mode, Hash: entry.Hash}
+	}
+	return files
+}
+
+//Store a working file as a blob and stage it
+func (idx index) stage(path string) error {
+	entry, info, err := storeWorkingFile(path)
+	if err != nil {
+		return err
+	}
+	if entry.Mode == "" {
+		return fmt.Errorf("%s: cannot stage special files", path)
+	}
+	//A file under what was staged as a file means that file has become a
+	//directory. (Entries under what is now a file are unstaged by add.)
+	for dir := path; strings.Contains(dir, "/"); {
+		dir = dir[:strings.LastIndexByte(dir, '/')]
+		delete(idx, dir)
+	}
+	idx[path] = indexEntry{
+		Path:  path,
+		Mode:  entry.Mode,
+		Hash:  entry.Hash,
+		Size:  info.Size(),
+		MTime: info.ModTime().UnixNano(),
+	}
+	return nil
+}
+
+//Report whether one of path's parent directories is staged as a file
+func (idx index) hasFileParent(path string) bool {
+	for dir := path; strings.Contains(dir, "/"); {
+		dir = dir[:strings.LastIndexByte(dir, '/')]
+		if _, ok := idx[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+//Return the staged entry for a working file if the file's size and
+//modification time are still what they were when it was staged, so its
+//staged hash can be trusted without hashing it again
+func (idx index) unchanged(path string, info os.FileInfo) (indexEntry, bool) {
+	staged, ok := idx[path]
+	return staged, ok && !info.IsDir() && staged.Size == info.Size() &&
+		staged.MTime == info.ModTime().UnixNano()
+}
+
+//Replace the whole index with a snapshot that has just been written to
+//the working directory (e.g. by checkout)
+func resetIndex(files map[string]treeEntry) error {
+	idx := index{}
+	for path, entry := range files {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		idx[path] = indexEntry{
+			Path:  path,
+			Mode:  entry.Mode,
+			Hash:  entry.Hash,
+			Size:  info.Size(),
+			MTime: info.ModTime().UnixNano(),
+		}
+	}
+	return writeIndex(idx)
+}
+
+//Turn a command-line path into the slash-separated, repository-relative
+//form used in the index. "." means the whole repository.
+func indexPath(arg string) (string, error) {
+	path := filepath.ToSlash(filepath.Clean(arg))
+	if path == ".." || strings.HasPrefix(path, "../") || filepath.IsAbs(arg) {
+		return "", fmt.Errorf("%s is outside the repository", arg)
+	}
+	if path == ".cap" || strings.HasPrefix(path, ".cap/") {
+		return "", fmt.Errorf("%s is inside .cap", arg)
+	}
+	return path, nil
+}
+
+//Report whether err means there is no file at a path, including when
+//one of the directories leading to it is now a file
+func isMissing(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+//Report whether path is the given path or lies underneath it
+func underPath(path, dir string) bool {
+	return dir == "." || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+//cap add <paths>
+//Stage files, and everything under directories, for the next commit.
+//Staged files that no longer exist on disk are unstaged.
+func add() {
+	if len(os.Args) < 3 {
+		log.Fatal("usage: cap add <paths>")
+	}
+	idx, err := readIndex()
+	checkError(err)
+	for _, arg := range os.Args[2:] {
+		dir, err := indexPath(arg)
+		checkError(err)
+		matched := false
+
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			path = filepath.ToSlash(path)
+			if info.IsDir() {
+				if info.Name() == ".cap" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+				//Sockets, devices and pipes can't be snapshotted
+				return nil
+			}
+			matched = true
+			return idx.stage(path)
+		})
+		if err != nil && !isMissing(err) {
+			log.Fatal(err)
+		}
+
+		//Stage deletions of files that have gone from disk, been replaced
+		//by a directory, or been replaced by a file where one of their
+		//parent directories was
+		for path := range idx {
+			if !underPath(path, dir) {
+				continue
+			}
+			info, err := os.Lstat(path)
+			if isMissing(err) || err == nil && info.IsDir() || idx.hasFileParent(path) {
+				delete(idx, path)
+				matched = true
+			}
+		}
+		if !matched {
+			log.Fatalf("%s did not match any files", arg)
+		}
+	}
+	checkError(writeIndex(idx))
+}
+
+//cap rm [--cached] [--force] <paths>
+//Unstage files and delete them from the working directory. With
+//--cached the working files are left alone. Files whose contents differ
+//from what is staged are only deleted with --force.
+func rm() {
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	cached := flags.Bool("cached", false, "only unstage; keep the working files")
+	force := flags.Bool("force", false, "delete files even if they have unstaged changes")
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() == 0 {
+		log.Fatal("usage: cap rm [--cached] [--force] <paths>")
+	}
+	idx, err := readIndex()
+	checkError(err)
+
+	removed := []string{}
+	for _, arg := range flags.Args() {
+		dir, err := indexPath(arg)
+		checkError(err)
+		matched := false
+		for path, entry := range idx {
+			if !underPath(path, dir) {
+				continue
+			}
+			matched = true
+			if !*cached && !*force {
+				working, err := hashWorkingFile(path)
+				if err == nil && (working.Hash != entry.Hash || working.Mode != entry.Mode) {
+					log.Fatalf("%s has unstaged changes (use --force to delete it anyway, "+
+						"or --cached to keep it)", path)
+				}
+			}
+			removed = append(removed, path)
+		}
+		if !matched {
+			log.Fatalf("%s is not staged", arg)
+		}
+	}
+
+	for _, path := range removed {
+		delete(idx, path)
+	}
+	checkError(writeIndex(idx))
+	if *cached {
+		return
+	}
+	for _, path := range removed {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		removeEmptyParents(path)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+//Kinds of line in an edit script
+const (
+	opEqual  = ' '
+	opDelete = '-'
+	opInsert = '+'
+)
+
+//One line of an edit script turning a into b. A and B are the line's
+//index in a and b; only the side(s) the line belongs to are meaningful.
+type diffOp struct {
+	Kind byte
+	A, B int
+}
+
+//Split data into lines, each keeping its trailing newline (the last
+//line may not have one)
+func splitLines(data []byte) []string {
+	lines := []string{}
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		lines = append(lines, string(data[:end]))
+		data = data[end:]
+	}
+	return lines
+}
+
+//Git's heuristic: a file with a NUL byte near the start is binary
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+//Compute a shortest edit script from a to b with Myers' O(ND) algorithm
+//(see "An O(ND) Difference Algorithm and Its Variations", 1986)
+func diffLines(a, b []string) []diffOp {
+	//Lines shared at the start and end never need to go through the
+	//search, which keeps it cheap for the common small edit
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := []diffOp{}
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{opEqual, i, i})
+	}
+	middle := myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	for _, op := range middle {
+		ops = append(ops, diffOp{op.Kind, op.A + prefix, op.B + prefix})
+	}
+	for i := suffix; i > 0; i-- {
+		ops = append(ops, diffOp{opEqual, len(a) - i, len(b) - i})
+	}
+	return ops
+}
+
+//Lines found on only one side can never be matched, so (as in git's
+//xdiff) they are left out of the search, which makes diffing unrelated
+//files cheap. The rest is matched with the linear-space variant of the
+//algorithm, so memory stays proportional to the number of lines.
+func myers(a, b []string) []diffOp {
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, line := range a {
+		inA[line] = true
+	}
+	for _, line := range b {
+		inB[line] = true
+	}
+	s := &lineMatcher{}
+	for i, line := range a {
+		if inB[line] {
+			s.a = append(s.a, line)
+			s.indexA = append(s.indexA, i)
+		}
+	}
+	for j, line := range b {
+		if inA[line] {
+			s.b = append(s.b, line)
+			s.indexB = append(s.indexB, j)
+		}
+	}
+	s.offset = (len(s.a)+len(s.b)+1)/2 + 1
+	s.forward = make([]int, 2*s.offset+1)
+	s.backward = make([]int, 2*s.offset+1)
+	s.match(0, len(s.a), 0, len(s.b))
+
+	//Everything between two matched lines is deleted from a, then
+	//inserted from b
+	ops := []diffOp{}
+	x, y := 0, 0
+	for _, m := range append(s.matches, [2]int{len(a), len(b)}) {
+		for ; x < m[0]; x++ {
+			ops = append(ops, diffOp{opDelete, x, y})
+		}
+		for ; y < m[1]; y++ {
+			ops = append(ops, diffOp{opInsert, x, y})
+		}
+		if x < len(a) {
+			ops = append(ops, diffOp{opEqual, x, y})
+			x++
+			y++
+		}
+	}
+	return ops
+}
+
+//State for finding a longest common subsequence of a and b, the lines
+//that can be matched. indexA and indexB map them back to their place in
+//the original files. forward and backward hold the furthest x reached
+//on each diagonal k (= x - y), stored at offset+k.
+type lineMatcher struct {
+	a, b              []string
+	indexA, indexB    []int
+	offset            int
+	forward, backward []int
+	//Pairs of matched line indexes in the original files, in order
+	matches [][2]int
+}
+
+//Match a[a0:a1] against b[b0:b1] by splitting them at the middle snake
+//(the run of equal lines halfway along a shortest edit script) and
+//matching each side of it
+func (s *lineMatcher) match(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && s.a[a0] == s.b[b0] {
+		s.matches = append(s.matches, [2]int{s.indexA[a0], s.indexB[b0]})
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a0 < a1-suffix && b0 < b1-suffix && s.a[a1-1-suffix] == s.b[b1-1-suffix] {
+		suffix++
+	}
+	a1 -= suffix
+	b1 -= suffix
+
+	//With the ends trimmed and both sides non-empty, at least two edits
+	//are needed, so both halves are smaller than the whole
+	if a0 < a1 && b0 < b1 {
+		x0, y0, x1, y1 := s.middleSnake(a0, a1, b0, b1)
+		s.match(a0, x0, b0, y0)
+		for ; x0 < x1; x0, y0 = x0+1, y0+1 {
+			s.matches = append(s.matches, [2]int{s.indexA[x0], s.indexB[y0]})
+		}
+		s.match(x1, a1, y1, b1)
+	}
+	for i := 0; i < suffix; i++ {
+		s.matches = append(s.matches, [2]int{s.indexA[a1+i], s.indexB[b1+i]})
+	}
+}
+
+//Search from both corners of a[a0:a1] against b[b0:b1] at once until
+//the paths meet, returning the start and end of the snake where they
+//do. The backward search works on the reversed lines, so its diagonal
+//k corresponds to the forward diagonal delta - k.
+func (s *lineMatcher) middleSnake(a0, a1, b0, b1 int) (int, int, int, int) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta%2 != 0
+	s.forward[s.offset+1], s.backward[s.offset+1] = 0, 0
+	for d := 0; ; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := s.forward[s.offset+k-1] + 1
+			if k == -d || (k != d && s.forward[s.offset+k-1] < s.forward[s.offset+k+1]) {
+				x = s.forward[s.offset+k+1]
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && s.a[a0+x] == s.b[b0+y] {
+				x++
+				y++
+			}
+			s.forward[s.offset+k] = x
+			if odd && delta-k >= -(d-1) && delta-k <= d-1 && x+s.backward[s.offset+delta-k] >= n {
+				return a0 + startX, b0 + startY, a0 + x, b0 + y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			x := s.backward[s.offset+k-1] + 1
+			if k == -d || (k != d && s.backward[s.offset+k-1] < s.backward[s.offset+k+1]) {
+				x = s.backward[s.offset+k+1]
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && s.a[a1-1-x] == s.b[b1-1-y] {
+				x++
+				y++
+			}
+			s.backward[s.offset+k] = x
+			if !odd && delta-k >= -d && delta-k <= d && x+s.forward[s.offset+delta-k] >= n {
+				return a1 - x, b1 - y, a1 - startX, b1 - startY
+			}
+		}
+	}
+}
+
+//Write a unified diff of a and b, labelled with the given names, with
+//context lines of context around each change. Binary contents are only
+//reported as differing. Returns whether there were any differences.
+func writeUnifiedDiff(w io.Writer, nameA, nameB string, a, b []byte, context int) (bool, error) {
+	if bytes.Equal(a, b) {
+		return false, nil
+	}
+	if isBinary(a) || isBinary(b) {
+		_, err := fmt.Fprintf(w, "Binary files %s and %s differ\n", nameA, nameB)
+		return true, err
+	}
+	linesA, linesB := splitLines(a), splitLines(b)
+	ops := diffLines(linesA, linesB)
+
+	_, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+	if err != nil {
+		return true, err
+	}
+	for _, hunk := range hunks(ops, context) {
+		err = writeHunk(w, ops[hunk[0]:hunk[1]], linesA, linesB)
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+//Group an edit script into hunks, returned as [start, end) ranges of
+//ops. Changes closer together than twice the context share a hunk.
+func hunks(ops []diffOp, context int) [][2]int {
+	if context < 0 {
+		context = 0
+	}
+	result := [][2]int{}
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == opEqual {
+			i++
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		//Extend over changes until a run of equal lines too long to bridge
+		end := i
+		for end < len(ops) {
+			if ops[end].Kind != opEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].Kind == opEqual {
+				run++
+			}
+			if run == len(ops) || run-end > 2*context {
+				break
+			}
+			end = run
+		}
+		i = end
+		end += context
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if len(result) > 0 && result[len(result)-1][1] >= start {
+			result[len(result)-1][1] = end
+		} else {
+			result = append(result, [2]int{start, end})
+		}
+	}
+	return result
+}
+
+func writeHunk(w io.Writer, ops []diffOp, a, b []string) error {
+	startA, startB := -1, -1
+	countA, countB := 0, 0
+	for _, op := range ops {
+		if op.Kind != opInsert {
+			if startA < 0 {
+				startA = op.A
+			}
+			countA++
+		}
+		if op.Kind != opDelete {
+			if startB < 0 {
+				startB = op.B
+			}
+			countB++
+		}
+	}
+	//An empty side is numbered by the line before it
+	if startA < 0 {
+		startA = ops[0].A - 1
+	}
+	if startB < 0 {
+		startB = ops[0].B - 1
+	}
+	_, err := fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(startA, countA), hunkRange(startB, countB))
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		var line string
+		if op.Kind == opDelete {
+			line = a[op.A]
+		} else {
+			line = b[op.B]
+		}
+		_, err = fmt.Fprintf(w, "%c%s", op.Kind, line)
+		if err == nil && (line == "" || line[len(line)-1] != '\n') {
+			_, err = io.WriteString(w, "\n\\ No newline at end of file\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Format a hunk's line range the way diff -u does: 1-based, with the
+//count left out when it is one
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func lines(s string) []string {
+	return splitLines([]byte(s))
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		edits int
+	}{
+		{"", "", 0},
+		{"a\n", "a\n", 0},
+		{"a\n", "", 1},
+		{"", "a\nb\n", 2},
+		{"a\nb\nc\n", "a\nc\n", 1},
+		{"a\nb\nc\n", "a\nx\nc\n", 2},
+		{"x\ny\n", "y\nx\n", 2},
+		{"a\nb", "a\nb\n", 2},
+		//The example from Myers' paper, ABCABBA to CBABAC
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n", 5},
+		{"a\nb\nc\nd\ne\nf\n", "a\nc\nd\nx\nf\ny\n", 4},
+	}
+	for _, test := range tests {
+		a, b := lines(test.a), lines(test.b)
+		ops := diffLines(a, b)
+		//Reading the script's a side and b side back must give a and b
+		gotA, gotB := []string{}, []string{}
+		edits := 0
+		for _, op := range ops {
+			if op.Kind != opInsert {
+				if op.A != len(gotA) {
+					t.Errorf("diffLines(%q, %q): op %c has A %d, want %d", test.a, test.b, op.Kind, op.A, len(gotA))
+				}
+				gotA = append(gotA, a[op.A])
+			}
+			if op.Kind != opDelete {
+				if op.B != len(gotB) {
+					t.Errorf("diffLines(%q, %q): op %c has B %d, want %d", test.a, test.b, op.Kind, op.B, len(gotB))
+				}
+				gotB = append(gotB, b[op.B])
+			}
+			if op.Kind == opEqual && a[op.A] != b[op.B] {
+				t.Errorf("diffLines(%q, %q): %q and %q marked equal", test.a, test.b, a[op.A], b[op.B])
+			}
+			if op.Kind != opEqual {
+				edits++
+			}
+		}
+		if strings.Join(gotA, "") != test.a || strings.Join(gotB, "") != test.b {
+			t.Errorf("diffLines(%q, %q) rebuilds %q and %q", test.a, test.b, strings.Join(gotA, ""), strings.Join(gotB, ""))
+		}
+		if edits != test.edits {
+			t.Errorf("diffLines(%q, %q) makes %d edits, want %d", test.a, test.b, edits, test.edits)
+		}
+	}
+}
+
+//Diffing big files with nothing (or little) in common must stay cheap
+//in memory, which a quadratic search would not
+func TestDiffLinesLarge(t *testing.T) {
+	const n = 100000
+	a, b, c := make([]string, n), make([]string, n), make([]string, n)
+	for i := range a {
+		a[i] = fmt.Sprintf("a%d\n", i)
+		b[i] = fmt.Sprintf("b%d\n", i)
+		c[i] = a[i]
+		if i%3 == 0 {
+			c[i] = b[i]
+		}
+	}
+	tests := []struct {
+		name  string
+		a, b  []string
+		edits int
+	}{
+		{"fully different", a, b, 2 * n},
+		{"every third line changed", a, c, 2 * (n + 2) / 3},
+	}
+	for _, test := range tests {
+		ops := diffLines(test.a, test.b)
+		edits := 0
+		for _, op := range ops {
+			if op.Kind != opEqual {
+				edits++
+			}
+		}
+		if edits != test.edits {
+			t.Errorf("%s: diffLines makes %d edits, want %d", test.name, edits, test.edits)
+		}
+	}
+}
+
+func TestHunks(t *testing.T) {
+	//Lines 2 and 9 of 10 changed, six equal lines apart
+	a := lines("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n")
+	b := lines("1\nB\n3\n4\n5\n6\n7\n8\nI\n10\n")
+	ops := diffLines(a, b)
+	tests := []struct {
+		context int
+		want    [][2]int
+	}{
+		{0, [][2]int{{1, 3}, {9, 11}}},
+		{1, [][2]int{{0, 4}, {8, 12}}},
+		{2, [][2]int{{0, 5}, {7, 12}}},
+		{3, [][2]int{{0, 12}}},
+		{-1, [][2]int{{1, 3}, {9, 11}}},
+	}
+	for _, test := range tests {
+		if got := hunks(ops, test.context); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("hunks with context %d = %v, want %v", test.context, got, test.want)
+		}
+	}
+	if got := hunks(diffLines(a, a), 3); len(got) != 0 {
+		t.Errorf("hunks of identical files = %v, want none", got)
+	}
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		context int
+		want    string
+	}{
+		{"a\n", "a\n", 3, ""},
+		{"a\nb\nc\n", "a\nB\nc\n", 3, "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"a\nb\nc\n", "a\nB\nc\n", 0, "--- a\n+++ b\n@@ -2 +2 @@\n-b\n+B\n"},
+		{"", "x\n", 3, "--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n"},
+		{"x\ny\n", "", 3, "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-x\n-y\n"},
+		{"a\nb\nc\nd\n", "a\nb\nd\n", 1, "--- a\n+++ b\n@@ -2,3 +2,2 @@\n b\n-c\n d\n"},
+		{"a", "b", 3, "--- a\n+++ b\n@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+b\n\\ No newline at end of file\n"},
+		{"a\n", "a", 3, "--- a\n+++ b\n@@ -1 +1 @@\n-a\n+a\n\\ No newline at end of file\n"},
+		{"a\x00", "b", 3, "Binary files a and b differ\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		differ, err := writeUnifiedDiff(&out, "a", "b", []byte(test.a), []byte(test.b), test.context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if differ != (test.a != test.b) {
+			t.Errorf("writeUnifiedDiff(%q, %q) reports differing %v", test.a, test.b, differ)
+		}
+		if out.String() != test.want {
+			t.Errorf("writeUnifiedDiff(%q, %q, %d) =\n%s\nwant\n%s", test.a, test.b, test.context, out.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+//One entry of `cap log --json`. Timestamp is RFC 3339 in the timezone
+//the commit was made in.
+type logEntry struct {
+	Hash      string   `json:"hash"`
+	Timestamp string   `json:"timestamp"`
+	Author    string   `json:"author,omitempty"`
+	Committer string   `json:"committer,omitempty"`
+	Message   string   `json:"message"`
+	Root      string   `json:"root"`
+	Parents   []string `json:"parents"`
+}
+
+//cap log [--oneline] [-n <count>] [--since <date>] [--until <date>]
+//        [--first-parent] [--json] [<rev>]
+//Starts at the current ref (or rev) and walks back through every
+//parent, newest commit first. --first-parent follows only the first
+//parent of merges, giving the history of the branch itself.
+func showLog() {
+	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	oneline := flags.Bool("oneline", false, "print one commit per line")
+	count := flags.Int("n", -1, "show at most this many commits")
+	since := flags.String("since", "", "only show commits at or after this date")
+	until := flags.String("until", "", "only show commits at or before this date")
+	asJSON := flags.Bool("json", false, "print commits as a JSON array")
+	firstParent := flags.Bool("first-parent", false, "follow only the first parent of merges")
+	parseFlags(flags, os.Args[2:])
+
+	var sinceTime, untilTime time.Time
+	var err error
+	if *since != "" {
+		sinceTime, err = parseDateArg(*since, false)
+		checkError(err)
+	}
+	if *until != "" {
+		untilTime, err = parseDateArg(*until, true)
+		checkError(err)
+	}
+
+	if flags.NArg() > 1 {
+		log.Fatal("usage: cap log [options] [<rev>]")
+	}
+	commit, err := readCurrentCommit()
+	if flags.NArg() == 1 {
+		commit, err = resolveRevision(flags.Arg(0))
+	}
+	checkError(err)
+	if commit == "" {
+		fmt.Fprintln(os.Stderr, noCommitsYet())
+		return
+	}
+	entries := []logEntry{}
+	walk := newHistoryWalk(*firstParent)
+	checkError(walk.push(commit))
+	for *count < 0 || len(entries) < *count {
+		commit, c, err := walk.next()
+		checkError(err)
+		if commit == "" {
+			break
+		}
+		entry := logEntry{
+			Hash:      commit,
+			Timestamp: c.Time.Format(time.RFC3339),
+			Message:   c.Message,
+			Root:      c.Root,
+			Parents:   c.Parents,
+		}
+		if c.Version >= 2 {
+			entry.Author = c.Author.String()
+			entry.Committer = c.Committer.String()
+		}
+
+		if (!sinceTime.IsZero() && c.Time.Before(sinceTime)) ||
+			(!untilTime.IsZero() && c.Time.After(untilTime)) {
+			continue
+		}
+		entries = append(entries, entry)
+		if !*asJSON {
+			printLogEntry(entry, *oneline)
+		}
+	}
+
+	if *asJSON {
+		output, err := json.MarshalIndent(entries, "", "  ")
+		checkError(err)
+		fmt.Println(string(output))
+	}
+}
+
+func printLogEntry(entry logEntry, oneline bool) {
+	if oneline {
+		fmt.Printf("%s %s\n", entry.Hash[:12], firstLine(entry.Message))
+		return
+	}
+	fmt.Printf("commit %s\n", entry.Hash)
+	if len(entry.Parents) > 1 {
+		fmt.Print("Merge:")
+		for _, parent := range entry.Parents {
+			fmt.Printf(" %s", parent[:12])
+		}
+		fmt.Println()
+	}
+	if entry.Author != "" {
+		fmt.Printf("Author: %s\n", entry.Author)
+	}
+	fmt.Printf("Date:   %s\n\n", entry.Timestamp)
+	for _, line := range strings.Split(entry.Message, "\n") {
+		fmt.Printf("    %s\n", line)
+	}
+	fmt.Println()
+}
+
+//Walks history from one or more commits, newest first, visiting each
+//commit once and never before all of its children (so a parent made in
+//the same second as a child still comes after it). Commits are read as
+//the walk reaches them rather than all up front, so showing the newest
+//few is cheap however long the history is. That relies on commits being
+//no older than their parents; with clocks that went backwards a parent
+//may be shown before a child, but never twice.
+type historyWalk struct {
+	firstParent bool
+	commits     map[string]commitObject
+	//Children found so far of each commit that are not yet visited
+	children map[string]int
+	//Commits read whose parents have not been read yet
+	unexpanded map[string]bool
+	queued     map[string]bool
+	pending    []string
+}
+
+func newHistoryWalk(firstParent bool) *historyWalk {
+	return &historyWalk{
+		firstParent: firstParent,
+		commits:     map[string]commitObject{},
+		children:    map[string]int{},
+		unexpanded:  map[string]bool{},
+		queued:      map[string]bool{},
+	}
+}
+
+//The parents a commit's history continues through
+func (w *historyWalk) parents(c commitObject) []string {
+	if w.firstParent && len(c.Parents) > 1 {
+		return c.Parents[:1]
+	}
+	return c.Parents
+}
+
+//Read a commit the walk has reached, unless it already has
+func (w *historyWalk) load(hash string) error {
+	if _, ok := w.commits[hash]; ok {
+		return nil
+	}
+	c, err := readCommit(hash)
+	if err != nil {
+		return err
+	}
+	w.commits[hash] = c
+	w.unexpanded[hash] = true
+	return nil
+}
+
+//Read a commit's parents, counting it as a child of each
+func (w *historyWalk) expand(hash string) error {
+	delete(w.unexpanded, hash)
+	for _, parent := range w.parents(w.commits[hash]) {
+		w.children[parent]++
+		err := w.load(parent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Queue a commit to be visited; "" (no commits yet) is ignored
+func (w *historyWalk) push(commit string) error {
+	if commit == "" || w.queued[commit] {
+		return nil
+	}
+	err := w.load(commit)
+	if err != nil {
+		return err
+	}
+	w.queued[commit] = true
+	w.pending = append(w.pending, commit)
+	return nil
+}
+
+//Report whether commit a comes before commit b: newer first, and by
+//hash when they were made at the same time
+func (w *historyWalk) before(a, b string) bool {
+	ta, tb := w.commits[a].Time, w.commits[b].Time
+	return ta.After(tb) || ta.Equal(tb) && a < b
+}
+
+//Return the newest queued commit whose children have all been visited,
+//and queue the parents that leaves with no children to wait for.
+//Returns an empty hash once the walk is finished.
+//1. Pick the newest queued commit with no unvisited children found yet
+//2. Any child not found yet lies behind a commit whose parents haven't
+//   been read, and is no older than the commit picked. So read the
+//   parents of the newest such commit at least as new, and start again.
+//3. Once there are none, visit the commit picked
+func (w *historyWalk) next() (string, commitObject, error) {
+	for {
+		newest := -1
+		for i, commit := range w.pending {
+			if w.children[commit] == 0 && (newest < 0 || w.before(commit, w.pending[newest])) {
+				newest = i
+			}
+		}
+		expand := ""
+		for hash := range w.unexpanded {
+			if newest >= 0 && (hash == w.pending[newest] ||
+				w.commits[hash].Time.Before(w.commits[w.pending[newest]].Time)) {
+				continue
+			}
+			if expand == "" || w.before(hash, expand) {
+				expand = hash
+			}
+		}
+		if expand != "" {
+			err := w.expand(expand)
+			if err != nil {
+				return "", commitObject{}, err
+			}
+			continue
+		}
+		if newest < 0 {
+			return "", commitObject{}, nil
+		}
+
+		commit := w.pending[newest]
+		w.pending = append(w.pending[:newest], w.pending[newest+1:]...)
+		if w.unexpanded[commit] {
+			err := w.expand(commit)
+			if err != nil {
+				return "", commitObject{}, err
+			}
+		}
+		c := w.commits[commit]
+		for _, parent := range w.parents(c) {
+			w.children[parent]--
+			if w.children[parent] == 0 && !w.queued[parent] {
+				w.queued[parent] = true
+				w.pending = append(w.pending, parent)
+			}
+		}
+		return commit, c, nil
+	}
+}
+
+func firstLine(message string) string {
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		return message[:i]
+	}
+	return message
+}
+
+//Parse a --since/--until argument, either RFC 3339 or a local date with
+//an optional time. A bare date given for an upper bound covers the
+//whole of that day.
+func parseDateArg(arg string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, arg); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", arg, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", arg, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("cannot parse date %q (use YYYY-MM-DD or RFC 3339)", arg)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
@@ -1,23 +1,33 @@
 package main
 
 import (
-	"encoding/hex"
-	"encoding/json"
+	"flag"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"strings"
 	"time"
-
-	"github.com/codahale/blake2"
 )
 
 var commands = map[string]func(){
-	"commit": commit,
-	"create": create,
-	"pull":   pull,
-	"push":   push,
-	"diff":   diff,
+	"branch":   branch,
+	"checkout": checkout,
+	"commit":   commit,
+	"config":   config,
+	"add":      add,
+	"rm":       rm,
+	"status":   status,
+	"tag":      tag,
+	"create":   create,
+	"pull":     pull,
+	"push":     push,
+	"diff":     diff,
+	"log":      showLog,
+	"merge":    merge,
+	"fsck":     fsck,
+	"reflog":   reflog,
+	"repack":   repack,
+	"gc":       gc,
 }
 
 func main() {
@@ -34,84 +44,126 @@ func main() {
 
 //1. Create necessary directories for a 'cap' project
 //   a. .cap directory
-//   b. .cap/refs directory (with /heads, /remotes and later /tags)
-//   c. .cap/objects directory (with all commits and blobs)
+//   b. .cap/refs directory (with /heads, /tags and later /remotes)
+//   c. .cap/objects directory (with all commits, trees and blobs)
+//2. Record the hash algorithm objects are named with (-hash)
+//3. Point HEAD at main, which stays unborn (has no ref file) until the
+//   first commit
 func create() {
-	err := os.MkdirAll(".cap/refs/heads", 0777)
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	hashName := flags.String("hash", defaultHash, "digest to name objects with")
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() != 0 {
+		log.Fatal("usage: cap create [-hash <algorithm>]")
+	}
+	h, err := findHashAlgorithm(*hashName)
+	checkError(err)
+	if _, err := os.Stat(".cap"); err == nil {
+		log.Fatal("a cap repository already exists here")
+	}
+
+	err = os.MkdirAll(".cap/refs/heads", 0777)
 	checkError(err)
-	refFile, err := os.Create(".cap/refs/heads/main")
+	err = os.Mkdir(".cap/refs/tags", 0777)
 	checkError(err)
-	refFile.Close()
 	err = os.Mkdir(".cap/objects", 0777)
 	checkError(err)
-	err = ioutil.WriteFile(".cap/HEAD", []byte("ref/heads/main"), 0666)
+	err = writeConfigValue(repoConfigFile, "core.hash", h.name, false)
+	checkError(err)
+	localHash = &h
+	err = writeHead("refs/heads/main")
 	checkError(err)
 }
 
-//1. Record the blob (root of project)
-//2. Make a hash of the blob
-//3. Make a commit (json file) pointing to the blob
-//4. Make a new directory for the commit
+//1. Record the tree of staged files (root of project)
+//2. Make a hash of the tree
+//3. Make a commit pointing to the tree (and, to finish a merge, the
+//   commit being merged in)
 //4. Update local ref of the current branch
+//Steps 1-4 hold the gc lock, so gc can't sweep the new objects before
+//the branch points at them.
 func commit() {
-	root, err := saveBlob("file.txt")
+	index, err := readIndex()
 	checkError(err)
+	for path, entry := range index {
+		if entry.Conflict {
+			log.Fatalf("%s has merge conflicts; fix them and `cap add` it first", path)
+		}
+	}
+	var merges []string
+	var message string
+	if mergeInProgress() {
+		mergeHead, err := readMergeHead()
+		checkError(err)
+		merges = []string{mergeHead}
+		contents, err := ioutil.ReadFile(mergeMsgFile)
+		checkError(err)
+		message = string(contents)
+	}
+	if len(os.Args) >= 3 {
+		message = os.Args[2]
+	}
 	//Throw error if there isn't a commit message.
 	//TODO: Is this something we want to enforce?
-	if len(os.Args) < 3 {
+	if message == "" {
 		log.Fatal("please provide a commit message")
 	}
-	commit, err := saveCommit(root)
+	lock, err := lockObjects()
 	checkError(err)
-	err = ioutil.WriteFile(".cap/refs/heads/main", []byte(commit), 0666)
+	err = commitIndex(index, message, merges)
+	lock.abort()
 	checkError(err)
+	clearMergeState()
 }
 
-//Prints out the difference between working directory and last commit
-func diff() {
-	commit, err := readCurrentCommit()
+func commitIndex(idx index, message string, merges []string) error {
+	root, err := writeTree(idx.files())
 	if err != nil {
-		log.Println("cannot read:", err)
-		os.Exit(2)
+		return err
 	}
-	var v struct{ Root string }
-	err = readJSONFile(".cap/objects/"+commit+".json", &v)
+	commit, err := saveCommit(root, message, merges)
 	if err != nil {
-		log.Println("cannot read:", err)
-		os.Exit(2)
-	}
-
-	cmd := exec.Command("diff", "file.txt", ".cap/objects/"+v.Root)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	if isExitStatus(err, 1) {
-		os.Exit(1)
+		return err
 	}
-	if err != nil {
-		log.Println("diff:", err)
-		os.Exit(2)
+	reason := "commit: "
+	if len(merges) > 0 {
+		reason = "commit (merge): "
 	}
+	return updateHead(commit, reason+firstLine(message))
 }
 
-// Looking at the other ("remote") copy of the repo
-// For now, this will be another copy of a 'cap' project
-// elsewhere on the same machine.
-// 1. Look at the commit in the remote ref.
-//    a. Go through linked list of commits to
-//       compare local ref to remote ref.
-//    b. If refs have diverged, serve an error
-//    c. If local ref is ahead, do nothing
-// 2. Copy all remote objects into local repo
-// 3. Update local ref (if necessary)
-func pull() {
-	// createConnection()
-	// createRemoteRefs() (create .cap/refs/remote)
-}
-
-func push() {
-	// createConnection()
-	// createRemoteRefs()
+//Parse a command's flags, which may come before, after or between its
+//other arguments (as in `cap log main -n 5`). Everything from a "--"
+//onwards is left, "--" included, for the command to interpret.
+func parseFlags(flags *flag.FlagSet, args []string) {
+	var flagArgs, positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			positional = append(positional, arg)
+			continue
+		}
+		flagArgs = append(flagArgs, arg)
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		//Non-boolean flags take the next argument as their value
+		f := flags.Lookup(name)
+		if f == nil || i+1 == len(args) {
+			continue
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		i++
+		flagArgs = append(flagArgs, args[i])
+	}
+	flags.Parse(append(append(flagArgs, "--"), positional...))
 }
 
 func checkError(e error) {
@@ -120,76 +172,70 @@ func checkError(e error) {
 	}
 }
 
-//Uses Blake2 to generate a hash given []byte
+//Uses Blake2, configured as the repository's core.hash says, to
+//generate a hash given []byte
 func blake2b(bytes []byte) []byte {
-	hash := blake2.NewBlake2B()
+	hash := repoHash().new()
 	hash.Write(bytes)
 	sum := hash.Sum(nil)
 	return sum
 }
 
-//Use this method to create individual file blobs
-//TODO: Create a new method (similar to this one) to hash directories
-func saveBlob(file string) (string, error) {
-	bytes, err := ioutil.ReadFile(file)
-	if err != nil {
-		return "", err
-	}
-	hex := hex.EncodeToString(blake2b(bytes))
-	err = ioutil.WriteFile(".cap/objects/"+hex, bytes, 0666)
-	if err != nil {
-		return "", err
-	}
-	return hex, nil
+//Store bytes as a blob named by their hash
+func writeBlob(bytes []byte) (string, error) {
+	return writeObject(typeBlob, bytes)
 }
 
 //1. Read the commit under the local ref for the current branch
-//2. Create directory for commit
-//3. Create JSON for commit
-//4. Hash commit JSON
-//5. Create file with hash as title
-
-//TODO: There is no canonical form for json; we're relying on the fact that the json
-//package produces consistent output. (We may be able to not keep the serialized bytes
-//to verify the hash)
-func saveCommit(root string) (string, error) {
+//2. Encode the commit canonically (see encodeCommit)
+//3. Store it as a commit object (named by its hash)
+func saveCommit(root, message string, merges []string) (string, error) {
 	previousCommit, err := readCurrentCommit()
 	if err != nil {
 		return "", err
 	}
 
-	jsonAttributes := map[string]string{"root": root,
-		"previous":  previousCommit,
-		"message":   os.Args[2],
-		"timestamp": time.Now().String()}
-	commitContent, _ := json.Marshal(jsonAttributes)
-	hash := hex.EncodeToString(blake2b(commitContent))
-	err = os.Mkdir(".cap/objects/"+hash[:2], 0777)
+	author, err := lookupIdentity("author")
 	if err != nil {
 		return "", err
 	}
-
-	err = ioutil.WriteFile(".cap/objects/"+hash+".json", commitContent, 0666)
+	committer, err := lookupIdentity("committer")
 	if err != nil {
 		return "", err
 	}
 
-	return hash, nil
+	parents := []string{}
+	if previousCommit != "" {
+		parents = append(parents, previousCommit)
+	}
+	commit := commitObject{
+		Version:   commitVersion,
+		Root:      root,
+		Parents:   append(parents, merges...),
+		Author:    author,
+		Committer: committer,
+		Message:   message,
+		//Whole seconds only; the monotonic reading is dropped too
+		Time: time.Now().Truncate(time.Second),
+	}
+	return writeObject(typeCommit, encodeCommit(commit))
 }
 
-//Read local ref of current branch
+//Read local ref of current branch (as named by HEAD), or the commit
+//HEAD points at directly when it is detached. Returns "" when the
+//current branch is unborn: it has no commits yet, so no ref file (or,
+//in repositories created before unborn branches, an empty one).
 func readCurrentCommit() (string, error) {
-	contents, err := ioutil.ReadFile(".cap/refs/heads/main")
+	head, err := readHead()
 	if err != nil {
 		return "", err
 	}
-	return string(contents), nil
-}
-
-func readJSONFile(filename string, v interface{}) error {
-	contents, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+	if isDetached(head) {
+		return head, nil
+	}
+	commit, err := readRef(head)
+	if os.IsNotExist(err) {
+		return "", nil
 	}
-	return json.Unmarshal(contents, v)
+	return commit, err
 }
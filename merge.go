@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+//While a merge with conflicts is waiting to be committed, MERGE_HEAD
+//holds the commit being merged in and MERGE_MSG the message to use
+const (
+	mergeHeadFile = ".cap/MERGE_HEAD"
+	mergeMsgFile  = ".cap/MERGE_MSG"
+)
+
+//cap merge <rev>
+//cap merge --abort
+//1. Find the merge base of the current commit and rev
+//2. If one contains the other, there is nothing to merge or we can
+//   fast-forward
+//3. Otherwise merge every file three ways (see mergeFiles)
+//4. Without conflicts, record a merge commit with both parents; with
+//   conflicts, write conflict markers and leave the merge for
+//   `cap add` and `cap commit` to finish
+//Steps 3-4 hold the gc lock, so gc can't sweep the merged files before
+//anything points at them.
+func merge() {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	abort := flags.Bool("abort", false, "abandon a merge with conflicts")
+	parseFlags(flags, os.Args[2:])
+	if *abort {
+		abortMerge()
+		return
+	}
+	if flags.NArg() != 1 {
+		log.Fatal("usage: cap merge <rev> | --abort")
+	}
+	if mergeInProgress() {
+		log.Fatal("a merge is already in progress; finish it with `cap commit` or `cap merge --abort`")
+	}
+
+	ours, err := readCurrentCommit()
+	checkError(err)
+	theirs, err := resolveRevision(flags.Arg(0))
+	checkError(err)
+	statuses, err := worktreeStatus()
+	checkError(err)
+	for _, s := range statuses {
+		if !s.Untracked {
+			log.Fatal("you have local changes; commit them before merging")
+		}
+	}
+
+	base, err := mergeBase(ours, theirs)
+	checkError(err)
+	if base == theirs {
+		fmt.Println("already up to date")
+		return
+	}
+	baseFiles, err := commitFiles(base)
+	checkError(err)
+	ourFiles, err := commitFiles(ours)
+	checkError(err)
+	theirFiles, err := commitFiles(theirs)
+	checkError(err)
+
+	if base == ours {
+		conflicts, err := checkoutConflicts(ourFiles, theirFiles)
+		checkError(err)
+		if len(conflicts) > 0 {
+			log.Fatalf("local changes would be overwritten by merge:\n\t%s", strings.Join(conflicts, "\n\t"))
+		}
+		checkError(restoreFiles(ourFiles, theirFiles))
+		checkError(updateHead(theirs, "merge "+flags.Arg(0)+": fast-forward"))
+		fmt.Printf("fast-forward to %s\n", theirs)
+		return
+	}
+
+	//Hold the gc lock from writing the merged blobs until a commit or
+	//the index points at them
+	lock, err := lockObjects()
+	checkError(err)
+	conflicts, err := mergeCommits(flags.Arg(0), theirs, baseFiles, ourFiles, theirFiles)
+	lock.abort()
+	checkError(err)
+	if len(conflicts) == 0 {
+		fmt.Printf("merged %s\n", flags.Arg(0))
+		return
+	}
+	fmt.Printf("conflicts in:\n\t%s\n", strings.Join(conflicts, "\n\t"))
+	fmt.Println("fix them, `cap add` the results and `cap commit` to finish the merge")
+	os.Exit(1)
+}
+
+//Merge theirs into the working directory and index, then record a
+//merge commit, or if any files conflict, leave the merge in progress
+//and return them
+func mergeCommits(label, theirs string, baseFiles, ourFiles, theirFiles map[string]treeEntry) ([]string, error) {
+	merged, conflicts, err := mergeFiles(baseFiles, ourFiles, theirFiles, label)
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := checkoutConflicts(ourFiles, merged)
+	if err != nil {
+		return nil, err
+	}
+	if len(untracked) > 0 {
+		return nil, fmt.Errorf("local changes would be overwritten by merge:\n\t%s", strings.Join(untracked, "\n\t"))
+	}
+	err = restoreFiles(ourFiles, merged)
+	if err != nil {
+		return nil, err
+	}
+
+	message := "Merge " + label
+	if branchName, err := currentBranch(); err == nil {
+		message += " into " + branchName
+	}
+	idx, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) == 0 {
+		root, err := writeTree(idx.files())
+		if err != nil {
+			return nil, err
+		}
+		commit, err := saveCommit(root, message, []string{theirs})
+		if err != nil {
+			return nil, err
+		}
+		return nil, updateHead(commit, "merge "+label+": "+message)
+	}
+
+	//Leave the conflicted files unstaged until they are resolved
+	for _, path := range conflicts {
+		entry := idx[path]
+		entry.Conflict = true
+		idx[path] = entry
+	}
+	err = writeIndex(idx)
+	if err == nil {
+		err = ioutil.WriteFile(mergeHeadFile, []byte(theirs), 0666)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(mergeMsgFile, []byte(message), 0666)
+	}
+	return conflicts, err
+}
+
+func mergeInProgress() bool {
+	_, err := os.Stat(mergeHeadFile)
+	return err == nil
+}
+
+//The commit being merged in by an unfinished merge
+func readMergeHead() (string, error) {
+	contents, err := ioutil.ReadFile(mergeHeadFile)
+	return strings.TrimSpace(string(contents)), err
+}
+
+func clearMergeState() {
+	os.Remove(mergeHeadFile)
+	os.Remove(mergeMsgFile)
+}
+
+//Put the working directory and index back to the current commit
+func abortMerge() {
+	if !mergeInProgress() {
+		log.Fatal("no merge in progress")
+	}
+	commit, err := readCurrentCommit()
+	checkError(err)
+	files, err := commitFiles(commit)
+	checkError(err)
+	idx, err := readIndex()
+	checkError(err)
+	checkError(restoreFiles(idx.files(), files))
+	clearMergeState()
+}
+
+//Find the best common ancestor of two commits: one that is an ancestor
+//of both and not an ancestor of any other such commit. If there is more
+//than one, the most recent is used. Returns "" if there is none.
+func mergeBase(a, b string) (string, error) {
+	if a == "" || b == "" {
+		return "", nil
+	}
+	ancestorsA, err := ancestors(a)
+	if err != nil {
+		return "", err
+	}
+	ancestorsB, err := ancestors(b)
+	if err != nil {
+		return "", err
+	}
+	common := map[string]bool{}
+	for commit := range ancestorsA {
+		if ancestorsB[commit] {
+			common[commit] = true
+		}
+	}
+
+	//Drop common ancestors reachable from another common ancestor
+	best := map[string]bool{}
+	for commit := range common {
+		best[commit] = true
+	}
+	for commit := range common {
+		if !best[commit] {
+			continue
+		}
+		below, err := ancestors(commit)
+		if err != nil {
+			return "", err
+		}
+		for other := range below {
+			if other != commit {
+				delete(best, other)
+			}
+		}
+	}
+
+	candidates := []commitObject{}
+	hashes := []string{}
+	for commit := range best {
+		c, err := readCommit(commit)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, c)
+		hashes = append(hashes, commit)
+	}
+	if len(hashes) == 0 {
+		return "", nil
+	}
+	newest := 0
+	for i := range candidates {
+		if candidates[i].Time.After(candidates[newest].Time) ||
+			candidates[i].Time.Equal(candidates[newest].Time) && hashes[i] < hashes[newest] {
+			newest = i
+		}
+	}
+	return hashes[newest], nil
+}
+
+//Every commit reachable from commit through any parent, commit included
+func ancestors(commit string) (map[string]bool, error) {
+	seen := map[string]bool{}
+	queue := []string{commit}
+	for len(queue) > 0 {
+		commit, queue = queue[0], queue[1:]
+		if commit == "" || seen[commit] {
+			continue
+		}
+		seen[commit] = true
+		c, err := readCommit(commit)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, c.Parents...)
+	}
+	return seen, nil
+}
+
+//Merge three snapshots file by file, writing merged contents as new
+//blobs. A file changed on only one side takes that side's version; a
+//file changed on both is merged line by line (see mergeLines). Returns
+//the merged snapshot and the paths left with conflicts, which hold
+//conflict markers (or, for binary files and modify/delete conflicts,
+//our version or whichever side still has the file).
+func mergeFiles(base, ours, theirs map[string]treeEntry, theirLabel string) (map[string]treeEntry, []string, error) {
+	paths := map[string]bool{}
+	for _, files := range []map[string]treeEntry{base, ours, theirs} {
+		for path := range files {
+			paths[path] = true
+		}
+	}
+	merged := map[string]treeEntry{}
+	conflicts := []string{}
+	for path := range paths {
+		b, inBase := base[path]
+		o, inOurs := ours[path]
+		t, inTheirs := theirs[path]
+		switch {
+		case inOurs == inTheirs && (!inOurs || sameContent(o, t)):
+			if inOurs {
+				merged[path] = o
+			}
+		case inBase == inOurs && (!inBase || sameContent(b, o)):
+			if inTheirs {
+				merged[path] = t
+			}
+		case inBase == inTheirs && (!inBase || sameContent(b, t)):
+			if inOurs {
+				merged[path] = o
+			}
+		case !inOurs || !inTheirs:
+			//Changed on one side, deleted on the other
+			if inOurs {
+				merged[path] = o
+			} else {
+				merged[path] = t
+			}
+			conflicts = append(conflicts, path)
+		default:
+			entry, clean, err := mergeFile(b, o, t, inBase, theirLabel)
+			if err != nil {
+				return nil, nil, err
+			}
+			merged[path] = entry
+			if !clean {
+				conflicts = append(conflicts, path)
+			}
+		}
+	}
+	sort.Strings(conflicts)
+	return merged, conflicts, nil
+}
+
+//Merge one file changed on both sides
+func mergeFile(base, ours, theirs treeEntry, inBase bool, theirLabel string) (treeEntry, bool, error) {
+	mode := ours.Mode
+	if inBase && ours.Mode == base.Mode {
+		mode = theirs.Mode
+	}
+	var baseBytes []byte
+	var err error
+	if inBase {
+		baseBytes, err = readBlob(base.Hash)
+		if err != nil {
+			return ours, false, err
+		}
+	}
+	ourBytes, err := readBlob(ours.Hash)
+	if err != nil {
+		return ours, false, err
+	}
+	theirBytes, err := readBlob(theirs.Hash)
+	if err != nil {
+		return ours, false, err
+	}
+	if mode == modeSymlink || isBinary(baseBytes) || isBinary(ourBytes) || isBinary(theirBytes) {
+		return ours, false, nil
+	}
+	result, clean := mergeLines(splitLines(baseBytes), splitLines(ourBytes), splitLines(theirBytes),
+		"HEAD", theirLabel)
+	hash, err := writeBlob(result)
+	return treeEntry{Name: ours.Name, Mode: mode, Hash: hash}, clean, err
+}
+
+//Three-way merge of lines, diff3 style: walk the lines of base that are
+//unchanged on both sides, and between them take whichever side changed
+//the lines in between. Where both sides changed them differently, write
+//both between conflict markers. Returns the result and whether it was
+//free of conflicts.
+func mergeLines(base, ours, theirs []string, ourLabel, theirLabel string) ([]byte, bool) {
+	matchOurs := matchLines(base, ours)
+	matchTheirs := matchLines(base, theirs)
+
+	var out bytes.Buffer
+	clean := true
+	i, o, t := 0, 0, 0
+	for {
+		for i < len(base) && matchOurs[i] == o && matchTheirs[i] == t {
+			out.WriteString(base[i])
+			i++
+			o++
+			t++
+		}
+		if i == len(base) && o == len(ours) && t == len(theirs) {
+			break
+		}
+
+		//The next base line that is unchanged on both sides, if any
+		next, endOurs, endTheirs := i, len(ours), len(theirs)
+		for ; next < len(base); next++ {
+			if matchOurs[next] >= 0 && matchTheirs[next] >= 0 {
+				endOurs, endTheirs = matchOurs[next], matchTheirs[next]
+				break
+			}
+		}
+		baseChunk, ourChunk, theirChunk := base[i:next], ours[o:endOurs], theirs[t:endTheirs]
+		switch {
+		case equalLines(ourChunk, baseChunk):
+			writeLines(&out, theirChunk)
+		case equalLines(theirChunk, baseChunk), equalLines(ourChunk, theirChunk):
+			writeLines(&out, ourChunk)
+		default:
+			clean = false
+			out.WriteString("<<<<<<< " + ourLabel + "\n")
+			writeLines(&out, ourChunk)
+			endLine(&out)
+			out.WriteString("=======\n")
+			writeLines(&out, theirChunk)
+			endLine(&out)
+			out.WriteString(">>>>>>> " + theirLabel + "\n")
+		}
+		i, o, t = next, endOurs, endTheirs
+	}
+	return out.Bytes(), clean
+}
+
+//For each line of base, the index of the same line in other when it is
+//unchanged by the diff from base to other, or -1
+func matchLines(base, other []string) []int {
+	match := make([]int, len(base))
+	for i := range match {
+		match[i] = -1
+	}
+	for _, op := range diffLines(base, other) {
+		if op.Kind == opEqual {
+			match[op.A] = op.B
+		}
+	}
+	return match
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(out *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+//Make sure a conflict marker starts on a line of its own
+func endLine(out *bytes.Buffer) {
+	if out.Len() > 0 && out.Bytes()[out.Len()-1] != '\n' {
+		out.WriteByte('\n')
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestMergeLines(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		clean              bool
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", "a\nb\n", "a\nb\n", true},
+		{"only ours changed", "a\nb\nc\n", "a\nB\nc\n", "a\nb\nc\n", "a\nB\nc\n", true},
+		{"only theirs changed", "a\nb\nc\n", "a\nb\nc\n", "a\nB\nc\n", "a\nB\nc\n", true},
+		{"same change on both sides", "a\nb\nc\n", "a\nB\nc\n", "a\nB\nc\n", "a\nB\nc\n", true},
+		{"separate changes", "a\nb\nc\nd\ne\n", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", true},
+		{"ours deletes", "a\nb\nc\n", "a\nc\n", "a\nb\nc\n", "a\nc\n", true},
+		{"theirs inserts", "a\nc\n", "a\nc\n", "a\nb\nc\n", "a\nb\nc\n", true},
+		{"both add the same file", "", "x\n", "x\n", "x\n", true},
+		{"conflicting change", "a\nb\nc\n", "a\nX\nc\n", "a\nY\nc\n",
+			"a\n<<<<<<< HEAD\nX\n=======\nY\n>>>>>>> feat\nc\n", false},
+		{"conflicting additions at the end", "a\n", "a\nx\n", "a\ny\n",
+			"a\n<<<<<<< HEAD\nx\n=======\ny\n>>>>>>> feat\n", false},
+		{"ours deletes what theirs changes", "a\nb\nc\n", "a\nc\n", "a\nB\nc\n",
+			"a\n<<<<<<< HEAD\n=======\nB\n>>>>>>> feat\nc\n", false},
+		{"no newline at end", "a", "b", "c",
+			"<<<<<<< HEAD\nb\n=======\nc\n>>>>>>> feat\n", false},
+	}
+	for _, test := range tests {
+		got, clean := mergeLines(lines(test.base), lines(test.ours), lines(test.theirs), "HEAD", "feat")
+		if string(got) != test.want || clean != test.clean {
+			t.Errorf("%s: mergeLines = %q, %v; want %q, %v", test.name, got, clean, test.want, test.clean)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+//Kinds of object kept in the object store
+const (
+	typeBlob   = "blob"
+	typeTree   = "tree"
+	typeCommit = "commit"
+	typeTag    = "tag"
+)
+
+//Every object is a header recording its type and size, "<type>
+//<size>\x00", followed by the content. The object's name is the hash of
+//header and content together, and it lives (compressed as
+//core.compression says) at .cap/objects/<hash[:2]>/<hash[2:]> so no
+//single directory grows too large.
+func objectHeader(kind string, size int64) []byte {
+	return []byte(kind + " " + strconv.FormatInt(size, 10) + "\x00")
+}
+
+//Work out the name an object would be stored under, without storing it
+func hashObject(kind string, content []byte) string {
+	data := append(objectHeader(kind, int64(len(content))), content...)
+	return hex.EncodeToString(blake2b(data))
+}
+
+func objectPath(capDir, hash string) string {
+	return filepath.Join(capDir, "objects", hash[:2], hash[2:])
+}
+
+//Report whether an object is stored, loose or in a pack
+func hasObject(capDir, hash string) bool {
+	if checkObjectName(hash) != nil {
+		return false
+	}
+	_, err := os.Stat(objectPath(capDir, hash))
+	return err == nil || isPacked(capDir, hash)
+}
+
+//Store an object in the local repository and return its hash
+func writeObject(kind string, content []byte) (string, error) {
+	return writeObjectIn(".cap", kind, content)
+}
+
+//Store an object in the given .cap directory. Objects are immutable and
+//named by their content, so one that is already there has already been
+//written and is left alone.
+func writeObjectIn(capDir, kind string, content []byte) (string, error) {
+	return writeObjectFrom(capDir, kind, bytes.NewReader(content), int64(len(content)))
+}
+
+//Store size bytes read from r as an object without holding them in
+//memory, so files of any size can be stored:
+//1. Copy header and content, compressed, to a temporary file in
+//   .cap/objects, hashing them uncompressed on the way through
+//2. Check exactly size bytes arrived (the file didn't change under us)
+//3. Rename the temporary file to the hash, unless that object exists
+func writeObjectFrom(capDir, kind string, r io.Reader, size int64) (string, error) {
+	var hash string
+	err := writeTempAndRename(filepath.Join(capDir, "objects"), 0444, func(temp io.Writer) (string, error) {
+		var err error
+		hash, err = compressObject(temp, kind, r, size)
+		if err != nil || hasObject(capDir, hash) {
+			return "", err
+		}
+		return objectPath(capDir, hash), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+//Write an object to w as a loose object file, compressed as
+//core.compression says, returning its hash
+func compressObject(w io.Writer, kind string, r io.Reader, size int64) (string, error) {
+	codec, err := objectCompression()
+	if err != nil {
+		return "", err
+	}
+	compressed := codec.compress(w)
+	hash, err := copyObjectContent(compressed, kind, r, size)
+	if closeErr := compressed.Close(); err == nil {
+		err = closeErr
+	}
+	return hash, err
+}
+
+//Work out the name an object would be stored under from a stream of
+//its content, without storing it
+func hashObjectFrom(kind string, r io.Reader, size int64) (string, error) {
+	return copyObjectContent(ioutil.Discard, kind, r, size)
+}
+
+//Write an object's header and size bytes of content from r to w,
+//returning the hash of everything written
+func copyObjectContent(w io.Writer, kind string, r io.Reader, size int64) (string, error) {
+	hash := repoHash().new()
+	w = io.MultiWriter(w, hash)
+	_, err := w.Write(objectHeader(kind, size))
+	if err != nil {
+		return "", err
+	}
+	//Read one byte more than expected, to notice content that grew
+	n, err := io.Copy(w, io.LimitReader(r, size+1))
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", fmt.Errorf("expected %d bytes, read %d (did the file change?)", size, n)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//Write data to a temporary file next to path and rename it into place,
+//so a crash never leaves a truncated file under the final name
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeTempAndRename(filepath.Dir(path), perm, func(temp io.Writer) (string, error) {
+		_, err := temp.Write(data)
+		return path, err
+	})
+}
+
+//Create a temporary file in dir, let fill write it, then rename it to
+//the path fill returns. If fill returns no path (or an error) the
+//temporary file is thrown away instead.
+func writeTempAndRename(dir string, perm os.FileMode, fill func(io.Writer) (string, error)) error {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	path, err := fill(temp)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && path != "" {
+		err = os.Chmod(temp.Name(), perm)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(path), 0777)
+		}
+		if err == nil {
+			err = os.Rename(temp.Name(), path)
+		}
+	}
+	if err != nil || path == "" {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+//Read an object from the local repository, returning its type and content
+func readObject(hash string) (string, []byte, error) {
+	return readObjectIn(".cap", hash)
+}
+
+func readObjectIn(capDir, hash string) (string, []byte, error) {
+	if err := checkObjectName(hash); err != nil {
+		return "", nil, err
+	}
+	file, err := os.Open(objectPath(capDir, hash))
+	if os.IsNotExist(err) {
+		data, found, packErr := readPacked(capDir, hash)
+		if packErr != nil {
+			return "", nil, packErr
+		}
+		if found {
+			return parseObject(hash, data)
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	r, err := decompressObject(bufio.NewReader(file))
+	if err != nil {
+		return "", nil, fmt.Errorf("object %s: %v", hash, err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("object %s: %v", hash, err)
+	}
+	return parseObject(hash, data)
+}
+
+//Split a stored object into its type and content, checking the header
+func parseObject(hash string, data []byte) (string, []byte, error) {
+	kind, size, end, err := parseHeader(hash, data)
+	if err != nil {
+		return "", nil, err
+	}
+	content := data[end:]
+	if int64(len(content)) != size {
+		return "", nil, fmt.Errorf("object %s: expected %d bytes, found %d", hash, size, len(content))
+	}
+	return kind, content, nil
+}
+
+//Parse the header at the start of a stored object, returning the type
+//and size it gives and where the content starts
+func parseHeader(hash string, data []byte) (string, int64, int, error) {
+	end := bytes.IndexByte(data, 0)
+	space := bytes.IndexByte(data, ' ')
+	if end < 0 || space < 0 || space > end {
+		return "", 0, 0, fmt.Errorf("object %s: malformed header", hash)
+	}
+	size, err := strconv.ParseInt(string(data[space+1:end]), 10, 64)
+	if err != nil || size < 0 {
+		return "", 0, 0, fmt.Errorf("object %s: malformed size", hash)
+	}
+	return string(data[:space]), size, end + 1, nil
+}
+
+//The longest header parseHeader could accept: a type name and a 64 bit
+//size, with room to spare
+const maxHeaderSize = 64
+
+//Open an object to read its content as a stream, rather than all at
+//once as readObjectIn does, returning its type and size from the
+//header. The content is checked against the size and the object's name
+//as it is read, so a corrupt object makes the last Read fail.
+func openObjectIn(capDir, hash string) (string, int64, io.ReadCloser, error) {
+	if err := checkObjectName(hash); err != nil {
+		return "", 0, nil, err
+	}
+	file, err := os.Open(objectPath(capDir, hash))
+	if os.IsNotExist(err) {
+		packed, found, packErr := openPacked(capDir, hash)
+		if packErr != nil {
+			return "", 0, nil, packErr
+		}
+		if found {
+			return streamObject(hash, packed, packed)
+		}
+	}
+	if err != nil {
+		return "", 0, nil, err
+	}
+	r, err := decompressObject(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return "", 0, nil, fmt.Errorf("object %s: %v", hash, err)
+	}
+	return streamObject(hash, r, file)
+}
+
+//Read the header from the uncompressed bytes of an object, returning a
+//reader for the content after it that closes closer when it is closed
+func streamObject(hash string, r io.Reader, closer io.Closer) (string, int64, io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header := []byte{}
+	for len(header) < maxHeaderSize && (len(header) == 0 || header[len(header)-1] != 0) {
+		b, err := buffered.ReadByte()
+		if err != nil {
+			break
+		}
+		header = append(header, b)
+	}
+	kind, size, _, err := parseHeader(hash, header)
+	if err != nil {
+		closer.Close()
+		return "", 0, nil, err
+	}
+	digest := repoHash().new()
+	digest.Write(header)
+	return kind, size, &objectReader{hash: hash, r: buffered, closer: closer, digest: digest, left: size}, nil
+}
+
+//Streams an object's content, failing on the last Read if there is
+//more or less of it than the header says or it doesn't match its name
+type objectReader struct {
+	hash   string
+	r      io.Reader
+	closer io.Closer
+	digest hash.Hash
+	left   int64
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.digest.Write(p[:n])
+	o.left -= int64(n)
+	switch {
+	case o.left < 0:
+		return n, fmt.Errorf("object %s: longer than its header says", o.hash)
+	case err == io.EOF && o.left > 0:
+		return n, fmt.Errorf("object %s: %d bytes short of what its header says", o.hash, o.left)
+	case err == io.EOF && hex.EncodeToString(o.digest.Sum(nil)) != o.hash:
+		return n, fmt.Errorf("object %s: does not match its hash", o.hash)
+	}
+	return n, err
+}
+
+func (o *objectReader) Close() error {
+	return o.closer.Close()
+}
+
+//Read an object that must be of the given type
+func readTypedObjectIn(capDir, hash, want string) ([]byte, error) {
+	kind, content, err := readObjectIn(capDir, hash)
+	if err != nil {
+		return nil, err
+	}
+	if kind != want {
+		return nil, fmt.Errorf("object %s is a %s, not a %s", hash, kind, want)
+	}
+	return content, nil
+}
+
+//Read a JSON-encoded object (tree, commit or tag) of the given type into v
+func readJSONObjectIn(capDir, hash, kind string, v interface{}) error {
+	content, err := readTypedObjectIn(capDir, hash, kind)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func readJSONObject(hash, kind string, v interface{}) error {
+	return readJSONObjectIn(".cap", hash, kind, v)
+}
+
+//Report whether hash names an object of the given type, reading no
+//more of it than its header
+func isObjectType(capDir, hash, want string) bool {
+	kind, _, content, err := openObjectIn(capDir, hash)
+	if err != nil {
+		return false
+	}
+	content.Close()
+	return kind == want
+}
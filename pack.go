@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//Packs gather many objects into one file, storing similar objects as
+//deltas against each other. Each pack is
+//.cap/objects/pack/pack-<hash>.pack, named by the hash of its contents,
+//with pack-<hash>.idx alongside: JSON mapping every object in the pack
+//to the offset of its entry. Packed objects are read by hash exactly
+//like loose ones (see readObjectIn).
+//
+//A pack file starts with packMagic, followed by its entries. Each entry
+//is one byte saying what it holds, then a zlib stream:
+//
+//	'o'  a whole object (header and content, as loose objects hold it)
+//	'd'  the uvarint offset of an earlier entry, then a delta (see
+//	     makeDelta) rebuilding this object from that one
+const packMagic = "CAPPACK1"
+
+const (
+	packWhole = 'o'
+	packDelta = 'd'
+)
+
+//How hard repack looks for deltas: each object is compared with this
+//many of the objects before it, deltas are never more than
+//maxDeltaDepth deep, and objects bigger than maxDeltaSize are stored
+//whole
+const (
+	deltaWindow   = 10
+	maxDeltaDepth = 10
+	maxDeltaSize  = 32 << 20
+)
+
+const packIndexVersion = 1
+
+type packIndex struct {
+	Version int              `json:"version"`
+	Objects map[string]int64 `json:"objects"`
+}
+
+//A pack whose index has been loaded
+type pack struct {
+	path    string
+	objects map[string]int64
+}
+
+//Packs of each .cap directory, loaded on first use
+var loadedPacks = map[string][]pack{}
+
+func packDir(capDir string) string {
+	return filepath.Join(capDir, "objects", "pack")
+}
+
+//Load the index of every pack in a .cap directory. A pack only counts
+//once its index exists, and the index is written last, so a half
+//written pack is never read.
+func packsIn(capDir string) ([]pack, error) {
+	if packs, ok := loadedPacks[capDir]; ok {
+		return packs, nil
+	}
+	indexes, err := filepath.Glob(filepath.Join(packDir(capDir), "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	packs := []pack{}
+	for _, indexPath := range indexes {
+		contents, err := ioutil.ReadFile(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		var idx packIndex
+		err = json.Unmarshal(contents, &idx)
+		if err == nil && idx.Version != packIndexVersion {
+			err = fmt.Errorf("unsupported version %d", idx.Version)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", indexPath, err)
+		}
+		packs = append(packs, pack{strings.TrimSuffix(indexPath, ".idx") + ".pack", idx.Objects})
+	}
+	loadedPacks[capDir] = packs
+	return packs, nil
+}
+
+func isPacked(capDir, hash string) bool {
+	packs, err := packsIn(capDir)
+	if err != nil {
+		return false
+	}
+	for _, p := range packs {
+		if _, ok := p.objects[hash]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+//Read an object's stored bytes (header and content) from whichever
+//pack holds it. found is false if no pack does.
+func readPacked(capDir, hash string) (data []byte, found bool, err error) {
+	packs, err := packsIn(capDir)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, p := range packs {
+		offset, ok := p.objects[hash]
+		if !ok {
+			continue
+		}
+		data, err := p.readEntry(offset, 0)
+		if err == nil && hex.EncodeToString(blake2b(data)) != hash {
+			err = fmt.Errorf("does not match its hash")
+		}
+		if err != nil {
+			return nil, true, fmt.Errorf("object %s in %s: %v", hash, filepath.Base(p.path), err)
+		}
+		return data, true, nil
+	}
+	return nil, false, nil
+}
+
+//Open an object's stored bytes (header and content) in whichever pack
+//holds it, for streaming. found is false if no pack does.
+func openPacked(capDir, hash string) (r io.ReadCloser, found bool, err error) {
+	packs, err := packsIn(capDir)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, p := range packs {
+		offset, ok := p.objects[hash]
+		if !ok {
+			continue
+		}
+		r, err := p.openEntry(offset)
+		if err != nil {
+			return nil, true, fmt.Errorf("object %s in %s: %v", hash, filepath.Base(p.path), err)
+		}
+		return r, true, nil
+	}
+	return nil, false, nil
+}
+
+//Open the entry at offset for streaming. Whole objects are decompressed
+//as they are read; deltas are rebuilt in memory, as they are only made
+//for objects up to maxDeltaSize.
+func (p pack) openEntry(offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	kind, err := r.ReadByte()
+	if err != nil || kind != packWhole {
+		file.Close()
+		data, err := p.readEntry(offset, 0)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{z, file}, nil
+}
+
+//Read the entry at offset, resolving deltas against earlier entries
+func (p pack) readEntry(offset int64, depth int) ([]byte, error) {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var base []byte
+	switch kind {
+	case packWhole:
+	case packDelta:
+		baseOffset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if int64(baseOffset) >= offset || depth >= maxDeltaDepth {
+			return nil, fmt.Errorf("bad delta base at offset %d", offset)
+		}
+		base, err = p.readEntry(int64(baseOffset), depth+1)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown entry type %q at offset %d", kind, offset)
+	}
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil || kind == packWhole {
+		return data, err
+	}
+	return applyDelta(base, data)
+}
+
+//List every object in a .cap directory, loose or packed
+func listObjects(capDir string) ([]string, error) {
+	seen := map[string]bool{}
+	dirs, err := ioutil.ReadDir(filepath.Join(capDir, "objects"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(capDir, "objects", dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !strings.HasPrefix(file.Name(), ".") {
+				seen[dir.Name()+file.Name()] = true
+			}
+		}
+	}
+	packs, err := packsIn(capDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packs {
+		for hash := range p.objects {
+			seen[hash] = true
+		}
+	}
+	hashes := make([]string, 0, len(seen))
+	for hash := range seen {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+//cap repack
+//Gather every object, loose or in older packs, into a single new pack
+func repack() {
+	flags := flag.NewFlagSet("repack", flag.ExitOnError)
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() != 0 {
+		log.Fatal("usage: cap repack")
+	}
+	//Hold the gc lock, so gc and repack never replace the packs at the
+	//same time
+	lock, err := lockObjects()
+	checkError(err)
+	hashes, err := listObjects(".cap")
+	packed, deltas := 0, 0
+	if err == nil {
+		packed, deltas, err = packObjects(".cap", hashes)
+	}
+	lock.abort()
+	checkError(err)
+	fmt.Printf("packed %d objects (%d as deltas)\n", packed, deltas)
+}
+
+//An object waiting to be packed
+type packCandidate struct {
+	hash string
+	kind string
+	size int64
+}
+
+//An object recently written to the pack, kept as a possible delta base
+type packedObject struct {
+	kind   string
+	data   []byte
+	offset int64
+	depth  int
+}
+
+//Write the given objects to one new pack, then remove them from loose
+//storage and remove every older pack (so anything in an older pack that
+//isn't listed is lost). Returns how many objects were packed and how
+//many of those as deltas.
+//1. Sort the objects so similar ones sit near each other: by type, then
+//   size, largest first (versions of a file tend to be close in size,
+//   and deltas that delete are smaller than ones that insert)
+//2. Store each as a delta against whichever of the previous few objects
+//   of its type gives the smallest delta, or whole if no delta is
+//   smaller than half the object
+//3. Write the index once the pack is complete, then clean up
+func packObjects(capDir string, hashes []string) (int, int, error) {
+	if len(hashes) == 0 {
+		return 0, 0, removePacks(capDir, "")
+	}
+	candidates := []packCandidate{}
+	for _, hash := range hashes {
+		//Only the header is needed to sort by
+		kind, size, content, err := openObjectIn(capDir, hash)
+		if err != nil {
+			return 0, 0, err
+		}
+		content.Close()
+		candidates = append(candidates, packCandidate{hash, kind, size})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.size != b.size {
+			return a.size > b.size
+		}
+		return a.hash < b.hash
+	})
+
+	offsets := map[string]int64{}
+	deltas := 0
+	var packPath string
+	err := writeTempAndRename(packDir(capDir), 0444, func(temp io.Writer) (string, error) {
+		packHash := repoHash().new()
+		w := &countingWriter{w: io.MultiWriter(temp, packHash)}
+		_, err := io.WriteString(w, packMagic)
+		if err != nil {
+			return "", err
+		}
+		window := []packedObject{}
+		for _, c := range candidates {
+			offsets[c.hash] = w.n
+			if c.size > maxDeltaSize {
+				err = packWholeObject(w, capDir, c.hash)
+				if err != nil {
+					return "", err
+				}
+				continue
+			}
+			kind, content, err := readObjectIn(capDir, c.hash)
+			if err != nil {
+				return "", err
+			}
+			obj := packedObject{kind: kind, data: append(objectHeader(kind, int64(len(content))), content...)}
+			var best []byte
+			var base packedObject
+			for _, candidate := range window {
+				if candidate.kind != kind || candidate.depth >= maxDeltaDepth {
+					continue
+				}
+				delta := makeDelta(candidate.data, obj.data)
+				if len(delta) < len(obj.data)/2 && (best == nil || len(delta) < len(best)) {
+					best, base = delta, candidate
+				}
+			}
+
+			obj.offset = w.n
+			entry := []byte{packWhole}
+			body := obj.data
+			if best != nil {
+				entry = appendUvarint([]byte{packDelta}, uint64(base.offset))
+				body = best
+				obj.depth = base.depth + 1
+				deltas++
+			}
+			_, err = w.Write(entry)
+			if err != nil {
+				return "", err
+			}
+			z := zlib.NewWriter(w)
+			_, err = z.Write(body)
+			if closeErr := z.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return "", err
+			}
+
+			window = append(window, obj)
+			if len(window) > deltaWindow {
+				window = window[1:]
+			}
+		}
+		packPath = filepath.Join(packDir(capDir), "pack-"+hex.EncodeToString(packHash.Sum(nil))+".pack")
+		return packPath, nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	index, err := json.Marshal(packIndex{Version: packIndexVersion, Objects: offsets})
+	if err != nil {
+		return 0, 0, err
+	}
+	err = writeFileAtomic(strings.TrimSuffix(packPath, ".pack")+".idx", index, 0444)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	//Everything is safely in the new pack, so the older packs and the
+	//loose copies can go
+	err = removePacks(capDir, packPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	for hash := range offsets {
+		err = os.Remove(objectPath(capDir, hash))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, 0, err
+		}
+		//Only succeeds once the directory is empty
+		os.Remove(filepath.Dir(objectPath(capDir, hash)))
+	}
+	return len(offsets), deltas, nil
+}
+
+//Write an object to a pack as a whole entry, streaming it through
+//rather than holding it in memory
+func packWholeObject(w io.Writer, capDir, hash string) error {
+	kind, size, content, err := openObjectIn(capDir, hash)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = w.Write([]byte{packWhole})
+	if err != nil {
+		return err
+	}
+	z := zlib.NewWriter(w)
+	_, err = z.Write(objectHeader(kind, size))
+	if err == nil {
+		_, err = io.Copy(z, content)
+	}
+	if closeErr := z.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//Copy a packed object out to a loose one, so it survives its pack
+//being removed
+func unpackObject(capDir, hash string) error {
+	kind, size, content, err := openObjectIn(capDir, hash)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return writeTempAndRename(filepath.Join(capDir, "objects"), 0444, func(temp io.Writer) (string, error) {
+		_, err := compressObject(temp, kind, content, size)
+		return objectPath(capDir, hash), err
+	})
+}
+
+//Remove every pack in a .cap directory except the one at keep. The
+//index goes first, so a pack is never listed without its data.
+func removePacks(capDir, keep string) error {
+	delete(loadedPacks, capDir)
+	packs, err := packsIn(capDir)
+	if err != nil {
+		return err
+	}
+	for _, p := range packs {
+		if p.path == keep {
+			continue
+		}
+		err = os.Remove(strings.TrimSuffix(p.path, ".pack") + ".idx")
+		if err == nil {
+			err = os.Remove(p.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	delete(loadedPacks, capDir)
+	return nil
+}
+
+//Count the bytes written through to w, so entries know their offsets
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Every change to a ref is appended to .cap/logs/<ref> (e.g.
+//.cap/logs/refs/heads/main), and every change to what HEAD points at
+//to .cap/logs/HEAD, one line per change, oldest first:
+//
+//	<old hash> <new hash> <RFC 3339 time> <name> <<email>>\t<reason>
+//
+//with "-" for the old hash of a ref that didn't exist before.
+type reflogEntry struct {
+	Old    string
+	New    string
+	Time   time.Time
+	Who    identity
+	Reason string
+}
+
+const noHash = "-"
+
+func reflogPath(capDir, ref string) string {
+	return filepath.Join(capDir, "logs", ref)
+}
+
+func encodeReflogEntry(e reflogEntry) string {
+	old := e.Old
+	if old == "" {
+		old = noHash
+	}
+	//Reasons come from commit messages and command lines, so keep them
+	//to one line
+	reason := strings.Join(strings.Fields(e.Reason), " ")
+	return fmt.Sprintf("%s %s %s %s\t%s\n", old, e.New, e.Time.Format(time.RFC3339), e.Who, reason)
+}
+
+func decodeReflogEntry(line string) (reflogEntry, error) {
+	var e reflogEntry
+	tab := strings.IndexByte(line, '\t')
+	if tab < 0 {
+		return e, fmt.Errorf("malformed reflog entry %q", line)
+	}
+	e.Reason = line[tab+1:]
+	fields := strings.SplitN(line[:tab], " ", 4)
+	if len(fields) != 4 {
+		return e, fmt.Errorf("malformed reflog entry %q", line)
+	}
+	e.Old, e.New = fields[0], fields[1]
+	if e.Old == noHash {
+		e.Old = ""
+	}
+	var err error
+	e.Time, err = time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return e, fmt.Errorf("malformed reflog time %q", fields[2])
+	}
+	e.Who, err = parseIdentity(fields[3])
+	return e, err
+}
+
+//Record that ref moved from old to next in the reflog of capDir. Made
+//by whoever would commit; ref updates aren't refused just because no
+//identity is configured.
+func appendReflog(capDir, ref, old, next, reason string) error {
+	who, err := lookupIdentity("committer")
+	if err != nil {
+		who = identity{Name: "unknown", Email: "unknown"}
+	}
+	entry := reflogEntry{Old: old, New: next, Time: time.Now().Truncate(time.Second), Who: who, Reason: reason}
+	path := reflogPath(capDir, ref)
+	err = os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(encodeReflogEntry(entry))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//Read the reflog of a ref in the local repository, oldest entry first.
+//A ref that has never changed has an empty reflog.
+func readReflog(ref string) ([]reflogEntry, error) {
+	entries := []reflogEntry{}
+	file, err := os.Open(reflogPath(".cap", ref))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry, err := decodeReflogEntry(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", reflogPath(".cap", ref), line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+//Drop reflog entries made before cutoff, always keeping the newest
+//entry of each log so <ref>@{0} still resolves. Returns how many
+//entries were dropped.
+func expireReflogs(cutoff time.Time) (int, error) {
+	logs, err := listReflogs()
+	if err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, ref := range logs {
+		entries, err := readReflog(ref)
+		if err != nil {
+			return dropped, err
+		}
+		kept := []string{}
+		for i, entry := range entries {
+			if i == len(entries)-1 || !entry.Time.Before(cutoff) {
+				kept = append(kept, encodeReflogEntry(entry))
+			}
+		}
+		if len(kept) == len(entries) {
+			continue
+		}
+		err = writeFileAtomic(reflogPath(".cap", ref), []byte(strings.Join(kept, "")), 0666)
+		if err != nil {
+			return dropped, err
+		}
+		dropped += len(entries) - len(kept)
+	}
+	return dropped, nil
+}
+
+//Forget the history of a ref that is being deleted
+func removeReflog(ref string) error {
+	err := os.Remove(reflogPath(".cap", ref))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//List every ref (and HEAD) that has a reflog
+func listReflogs() ([]string, error) {
+	refs := []string{}
+	if _, err := os.Stat(reflogPath(".cap", "HEAD")); err == nil {
+		refs = append(refs, "HEAD")
+	}
+	names, err := listRefs("logs/refs")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		refs = append(refs, "refs/"+name)
+	}
+	return refs, nil
+}
+
+//Find the ref a name such as HEAD, main, v1.0 or origin/main refers to,
+//trying the same places as resolveRevisionName
+func reflogRef(name string) (string, error) {
+	if name == "" || name == "HEAD" {
+		return "HEAD", nil
+	}
+	for _, ref := range []string{name, "refs/" + name, "refs/tags/" + name,
+		"refs/heads/" + name, "refs/remotes/" + name} {
+		if !strings.HasPrefix(ref, "refs/") {
+			continue
+		}
+		if _, err := os.Stat(reflogPath(".cap", ref)); err == nil || refExists(ref) {
+			return ref, nil
+		}
+	}
+	return "", fmt.Errorf("unknown ref %s", name)
+}
+
+//Resolve <ref>@{n}: the value ref had n changes ago, so @{0} is its
+//current value. found is false if rev isn't of that form.
+func resolveReflogRevision(rev string) (commit string, found bool, err error) {
+	at := strings.LastIndex(rev, "@{")
+	if at < 0 || !strings.HasSuffix(rev, "}") {
+		return "", false, nil
+	}
+	n, err := strconv.Atoi(rev[at+2 : len(rev)-1])
+	if err != nil || n < 0 {
+		return "", true, fmt.Errorf("invalid revision %s", rev)
+	}
+	ref, err := reflogRef(rev[:at])
+	if err != nil {
+		return "", true, err
+	}
+	entries, err := readReflog(ref)
+	if err != nil {
+		return "", true, err
+	}
+	if n >= len(entries) {
+		return "", true, fmt.Errorf("%s: the reflog of %s has only %d %s", rev, ref,
+			len(entries), plural(len(entries), "entry", "entries"))
+	}
+	commit = entries[len(entries)-1-n].New
+	if commit == "" {
+		return "", true, fmt.Errorf("%s: %s did not exist then", rev, ref)
+	}
+	commit, err = peelToCommit(commit)
+	return commit, true, err
+}
+
+//cap reflog [<ref>]
+//List the changes to a ref (HEAD by default), newest first, numbered
+//as they can be named with <ref>@{n}
+func reflog() {
+	flags := flag.NewFlagSet("reflog", flag.ExitOnError)
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() > 1 {
+		log.Fatal("usage: cap reflog [<ref>]")
+	}
+	name := flags.Arg(0)
+	if name == "" {
+		name = "HEAD"
+	}
+	ref, err := reflogRef(name)
+	checkError(err)
+	entries, err := readReflog(ref)
+	checkError(err)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		short := e.New
+		if len(short) > 12 {
+			short = short[:12]
+		}
+		fmt.Printf("%s %s@{%d}: %s (%s, %s)\n", short, name, len(entries)-1-i, e.Reason,
+			e.Who.Name, e.Time.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//.cap/HEAD holds the ref of the current branch (e.g. refs/heads/main),
+//or a bare commit hash when HEAD is detached.
+//Older repositories were created with "ref/heads/main", which is
+//treated as the same thing.
+func readHead() (string, error) {
+	return readHeadIn(".cap")
+}
+
+func readHeadIn(capDir string) (string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(capDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	head := strings.TrimSpace(string(contents))
+	if strings.HasPrefix(head, "ref/") {
+		head = "refs/" + strings.TrimPrefix(head, "ref/")
+	}
+	if head == "" {
+		return "", errors.New("HEAD is empty")
+	}
+	return head, nil
+}
+
+//Point HEAD at a ref such as refs/heads/main, or at a bare commit hash
+//to detach it
+func writeHead(ref string) error {
+	return ioutil.WriteFile(".cap/HEAD", []byte(ref), 0666)
+}
+
+func isDetached(head string) bool {
+	return !strings.HasPrefix(head, "refs/")
+}
+
+//Move whatever HEAD points at to commit: the current branch, or HEAD
+//itself when it is detached. reason is recorded in the reflog.
+func updateHead(commit, reason string) error {
+	head, err := readHead()
+	if err != nil {
+		return err
+	}
+	if !isDetached(head) {
+		return writeRef(head, commit, reason)
+	}
+	err = writeHead(commit)
+	if err != nil {
+		return err
+	}
+	return appendReflog(".cap", "HEAD", head, commit, reason)
+}
+
+//Name of the branch HEAD points at (e.g. "main")
+func currentBranch() (string, error) {
+	head, err := readHead()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(head, "refs/heads/") {
+		return "", fmt.Errorf("HEAD does not point at a branch: %s", head)
+	}
+	return strings.TrimPrefix(head, "refs/heads/"), nil
+}
+
+//Explain that the current branch has no commits yet
+func noCommitsYet() string {
+	if name, err := currentBranch(); err == nil {
+		return "branch " + name + " has no commits yet"
+	}
+	return "no commits yet"
+}
+
+//Read the commit hash stored in a ref (e.g. refs/heads/main)
+func readRef(ref string) (string, error) {
+	return readRefIn(".cap", ref)
+}
+
+//Read a ref from the given .cap directory, e.g. a remote repository's
+func readRefIn(capDir, ref string) (string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(capDir, ref))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+//Store a commit hash in a ref, creating any directories it needs, and
+//record why in the reflog
+func writeRef(ref, hash, reason string) error {
+	return writeRefIn(".cap", ref, hash, reason)
+}
+
+//Store a commit hash in a ref of the given .cap directory
+func writeRefIn(capDir, ref, hash, reason string) error {
+	lock, err := lockRef(capDir, ref)
+	if err != nil {
+		return err
+	}
+	return lock.commit(hash, reason)
+}
+
+//A ref being updated. While it is held, <ref>.lock exists so no one
+//else can update the same ref; the new value is written to the lock
+//file and renamed over the ref, so readers only ever see the old or
+//the new hash.
+type refLock struct {
+	capDir string
+	ref    string
+	path   string
+	file   *os.File
+}
+
+func lockRef(capDir, ref string) (*refLock, error) {
+	path := filepath.Join(capDir, ref)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%s is locked by another cap process (remove %s.lock if it is stale)", ref, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &refLock{capDir: capDir, ref: ref, path: path, file: file}, nil
+}
+
+//Write hash to the ref and release the lock, then record the change
+//(and why it was made) in the reflog of the ref, and of HEAD if HEAD
+//points at the ref
+func (l *refLock) commit(hash, reason string) error {
+	old, err := readRefIn(l.capDir, l.ref)
+	if err != nil && !os.IsNotExist(err) {
+		l.abort()
+		return err
+	}
+	_, err = l.file.WriteString(hash)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(l.path + ".lock")
+		return err
+	}
+	err = os.Rename(l.path+".lock", l.path)
+	if err != nil {
+		return err
+	}
+	err = appendReflog(l.capDir, l.ref, old, hash, reason)
+	if head, headErr := readHeadIn(l.capDir); err == nil && headErr == nil && head == l.ref {
+		err = appendReflog(l.capDir, "HEAD", old, hash, reason)
+	}
+	return err
+}
+
+//Release the lock without changing the ref
+func (l *refLock) abort() {
+	l.file.Close()
+	os.Remove(l.path + ".lock")
+}
+
+func refExists(ref string) bool {
+	info, err := os.Stat(filepath.Join(".cap", ref))
+	return err == nil && !info.IsDir()
+}
+
+//List the names of all refs under dir (e.g. refs/heads), relative to it
+func listRefs(dir string) ([]string, error) {
+	return listRefsIn(".cap", dir)
+}
+
+//List refs under dir in the given .cap directory
+func listRefsIn(capDir, dir string) ([]string, error) {
+	root := filepath.Join(capDir, dir)
+	names := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	return names, err
+}
+
+//Branch names may contain slashes but no empty, hidden or ".." components
+func checkRefName(name string) error {
+	if name == "" || strings.HasPrefix(name, "-") || strings.HasSuffix(name, "/") {
+		return fmt.Errorf("%q is not a valid name", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, " ~^:?*[\\") ||
+			strings.Contains(part, "@{") {
+			return fmt.Errorf("%q is not a valid name", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Locate the .cap directory of a remote repository on this machine
+func remoteCapDir(path string) (string, error) {
+	capDir := filepath.Join(path, ".cap")
+	info, err := os.Stat(capDir)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s is not a cap repository", path)
+	}
+	return capDir, nil
+}
+
+//Copy every object reachable from commit in src that dst lacks.
+//History is assumed complete below any commit dst already has, so the
+//walk stops there. Returns the number of objects copied.
+func copyMissingObjects(src, dst, commit string) (int, error) {
+	//Find the missing commits, listed so that every commit comes after
+	//all of its parents
+	missing := []string{}
+	roots := map[string]string{}
+	visited := map[string]bool{}
+	var visit func(commit string) error
+	visit = func(commit string) error {
+		if commit == "" || visited[commit] || hasObject(dst, commit) {
+			return nil
+		}
+		visited[commit] = true
+		c, err := readCommitIn(src, commit)
+		if err != nil {
+			return err
+		}
+		for _, parent := range c.Parents {
+			err = visit(parent)
+			if err != nil {
+				return err
+			}
+		}
+		roots[commit] = c.Root
+		missing = append(missing, commit)
+		return nil
+	}
+	err := visit(commit)
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for _, commit := range missing {
+		n, err := copyMissingTree(src, dst, roots[commit])
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+		//Copy the commit itself after its tree and parents, so an
+		//interrupted pull never leaves a commit whose history is missing
+		err = copyObject(src, dst, commit)
+		if err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+func copyMissingTree(src, dst, tree string) (int, error) {
+	if hasObject(dst, tree) {
+		return 0, nil
+	}
+	var entries []treeEntry
+	err := readJSONObjectIn(src, tree, typeTree, &entries)
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, entry := range entries {
+		if entry.isTree() {
+			n, err := copyMissingTree(src, dst, entry.Hash)
+			copied += n
+			if err != nil {
+				return copied, err
+			}
+			continue
+		}
+		if hasObject(dst, entry.Hash) {
+			continue
+		}
+		err = copyObject(src, dst, entry.Hash)
+		if err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	err = copyObject(src, dst, tree)
+	if err != nil {
+		return copied, err
+	}
+	return copied + 1, nil
+}
+
+//Copy what a tag ref points at, and everything reachable from it, from
+//src to dst: a commit and its history, or an annotated tag object
+//together with the object it tags
+func copyMissingTagged(src, dst, hash string) (int, error) {
+	kind, content, err := readObjectIn(src, hash)
+	if err != nil {
+		return 0, err
+	}
+	if kind != typeTag {
+		return copyMissingObjects(src, dst, hash)
+	}
+	if hasObject(dst, hash) {
+		return 0, nil
+	}
+	t, err := decodeTag(hash, content)
+	if err != nil {
+		return 0, err
+	}
+	copied, err := copyMissingTagged(src, dst, t.Object)
+	if err != nil {
+		return copied, err
+	}
+	return copied + 1, copyObject(src, dst, hash)
+}
+
+//Copy every tag in src that dst lacks, along with the objects it needs.
+//Tags that exist on both sides but differ are left alone unless force
+//is set, since tags are not expected to move. Returns the number of
+//objects copied.
+func transferTags(src, dst string, force bool, reason string) (int, error) {
+	names, err := listRefsIn(src, "refs/tags")
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, name := range names {
+		ref := "refs/tags/" + name
+		hash, err := readRefIn(src, ref)
+		if err != nil {
+			return copied, err
+		}
+		existing, err := readRefIn(dst, ref)
+		if err != nil && !os.IsNotExist(err) {
+			return copied, err
+		}
+		if existing == hash {
+			continue
+		}
+		if existing != "" && !force {
+			fmt.Printf("skipping tag %s: it differs between the two repositories\n", name)
+			continue
+		}
+		n, err := copyMissingTagged(src, dst, hash)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+		err = writeRefIn(dst, ref, hash, reason)
+		if err != nil {
+			return copied, err
+		}
+		fmt.Printf("tag %s -> %s\n", name, hash)
+	}
+	return copied, nil
+}
+
+//Copy a single object file as stored, streaming it through a temporary
+//file so a partial copy is never mistaken for a complete object.
+//Packed objects are streamed out into loose ones.
+func copyObject(src, dst, hash string) error {
+	file, err := os.Open(objectPath(src, hash))
+	if os.IsNotExist(err) && isPacked(src, hash) {
+		kind, size, content, err := openObjectIn(src, hash)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		_, err = writeObjectFrom(dst, kind, content, size)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeTempAndRename(filepath.Join(dst, "objects"), 0444, func(temp io.Writer) (string, error) {
+		_, err := io.Copy(temp, file)
+		return objectPath(dst, hash), err
+	})
+}
+
+//Report whether ancestor is reachable through any parents from
+//descendant in the local repository. Every commit counts as its own
+//ancestor; the empty string (no commits yet) is an ancestor of all.
+func isAncestor(ancestor, descendant string) (bool, error) {
+	if ancestor == "" {
+		return true, nil
+	}
+	seen := map[string]bool{}
+	queue := []string{descendant}
+	for len(queue) > 0 {
+		commit := queue[0]
+		queue = queue[1:]
+		if commit == ancestor {
+			return true, nil
+		}
+		if commit == "" || seen[commit] {
+			continue
+		}
+		seen[commit] = true
+		c, err := readCommit(commit)
+		if err != nil {
+			return false, err
+		}
+		queue = append(queue, c.Parents...)
+	}
+	return false, nil
+}
+
+var errDiverged = errors.New("histories have diverged")
+
+// Looking at the other ("remote") copy of the repo
+// For now, this will be another copy of a 'cap' project
+// elsewhere on the same machine.
+// cap pull [-name <remote>] <path> [<branch>]
+// 1. Look at the commit in the remote ref.
+// 2. Copy missing remote objects into local repo
+// 3. Record the remote head under .cap/refs/remotes/<remote>/<branch>
+//    and fetch any tags we don't have
+// 4. Compare local ref to remote ref.
+//    a. If refs have diverged, serve an error
+//    b. If local ref is ahead, do nothing
+//    c. Otherwise fast-forward the local ref (and working files,
+//       if it is the checked out branch)
+func pull() {
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	name := flags.String("name", "origin", "name to record the remote's refs under")
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		log.Fatal("usage: cap pull [-name <remote>] <path> [<branch>]")
+	}
+	checkError(checkRefName(*name))
+	src, err := remoteCapDir(flags.Arg(0))
+	checkError(err)
+	checkError(checkSameHash(src))
+	branchName := flags.Arg(1)
+	if branchName == "" {
+		branchName, err = currentBranch()
+		checkError(err)
+	}
+	checkError(checkRefName(branchName))
+
+	remoteHead, err := readRefIn(src, "refs/heads/"+branchName)
+	if os.IsNotExist(err) {
+		log.Fatalf("remote has no branch %s", branchName)
+	}
+	checkError(err)
+	if remoteHead == "" {
+		log.Fatalf("remote branch %s has no commits", branchName)
+	}
+
+	copied, err := copyMissingObjects(src, ".cap", remoteHead)
+	checkError(err)
+	reason := "pull " + flags.Arg(0)
+	checkError(writeRef("refs/remotes/"+*name+"/"+branchName, remoteHead, reason))
+	n, err := transferTags(src, ".cap", false, reason)
+	copied += n
+	checkError(err)
+	fmt.Printf("fetched %d objects from %s\n", copied, flags.Arg(0))
+
+	err = fastForward(branchName, remoteHead, reason+": fast-forward")
+	if err == errDiverged {
+		log.Fatalf("cannot pull %s: local and remote %s", branchName, err)
+	}
+	checkError(err)
+}
+
+//Move a local branch forward to commit, refusing if that would discard
+//local commits. The working directory follows if the branch is checked out.
+func fastForward(branchName, commit, reason string) error {
+	ref := "refs/heads/" + branchName
+	local, err := readRef(ref)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if local == commit {
+		fmt.Println("already up to date")
+		return nil
+	}
+	behind, err := isAncestor(local, commit)
+	if err != nil {
+		return err
+	}
+	if !behind {
+		ahead, err := isAncestor(commit, local)
+		if err != nil {
+			return err
+		}
+		if ahead {
+			fmt.Println("local branch is ahead of remote; nothing to do")
+			return nil
+		}
+		return errDiverged
+	}
+
+	head, err := readHead()
+	if err != nil {
+		return err
+	}
+	if head == ref {
+		from, err := commitFiles(local)
+		if err != nil {
+			return err
+		}
+		to, err := commitFiles(commit)
+		if err != nil {
+			return err
+		}
+		conflicts, err := checkoutConflicts(from, to)
+		if err != nil {
+			return err
+		}
+		if len(conflicts) > 0 {
+			return fmt.Errorf("local changes would be overwritten by pull:\n\t%s",
+				strings.Join(conflicts, "\n\t"))
+		}
+		err = restoreFiles(from, to)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("fast-forward %s to %s\n", branchName, commit)
+	return writeRef(ref, commit, reason)
+}
+
+//cap push [-force] [-checked-out] [-name <remote>] <path> [<branch>]
+//1. Refuse to move the branch the remote has checked out, which would
+//   leave its index and working files describing the old commit (so
+//   its next commit would undo ours), unless -checked-out is given
+//2. Copy every object reachable from the local branch that the remote lacks
+//3. Lock the remote ref, then check its head is an ancestor of ours
+//   (skipped with -force)
+//4. Move the remote ref and record it under .cap/refs/remotes/<remote>
+//5. Send any tags the remote lacks (-force replaces ones that differ)
+func push() {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	force := flags.Bool("force", false, "update the remote ref even if it is not a fast-forward")
+	checkedOut := flags.Bool("checked-out", false,
+		"update the branch the remote has checked out, leaving its working files behind")
+	name := flags.String("name", "origin", "name to record the remote's refs under")
+	parseFlags(flags, os.Args[2:])
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		log.Fatal("usage: cap push [-force] [-checked-out] [-name <remote>] <path> [<branch>]")
+	}
+	checkError(checkRefName(*name))
+	dst, err := remoteCapDir(flags.Arg(0))
+	checkError(err)
+	checkError(checkSameHash(dst))
+	branchName := flags.Arg(1)
+	if branchName == "" {
+		branchName, err = currentBranch()
+		checkError(err)
+	}
+	checkError(checkRefName(branchName))
+	ref := "refs/heads/" + branchName
+	local, err := readRef(ref)
+	if os.IsNotExist(err) || local == "" {
+		log.Fatalf("branch %s has no commits to push", branchName)
+	}
+	checkError(err)
+	checkedOutRef, err := readHeadIn(dst)
+	checkError(err)
+	if checkedOutRef == ref && !*checkedOut {
+		log.Fatalf("rejected: %s is checked out in %s, and its working files would not be updated "+
+			"(push another branch and merge it there, or use -checked-out)", branchName, flags.Arg(0))
+	}
+
+	copied, err := copyMissingObjects(".cap", dst, local)
+	checkError(err)
+	fmt.Printf("sent %d objects to %s\n", copied, flags.Arg(0))
+
+	//Hold the remote ref's lock while deciding, so nobody moves it
+	//between the ancestry check and the update
+	lock, err := lockRef(dst, ref)
+	checkError(err)
+	remoteHead, err := readRefIn(dst, ref)
+	if err != nil && !os.IsNotExist(err) {
+		lock.abort()
+		log.Fatal(err)
+	}
+	if remoteHead == local {
+		lock.abort()
+		fmt.Println("everything up to date")
+		pushTags(dst, *force)
+		return
+	}
+	if !*force {
+		//Anything we don't have locally can't be in our history
+		fastForward := remoteHead == "" || hasObject(".cap", remoteHead)
+		if fastForward {
+			fastForward, err = isAncestor(remoteHead, local)
+		}
+		if err != nil || !fastForward {
+			lock.abort()
+			checkError(err)
+			log.Fatalf("rejected: remote %s is not an ancestor of local %s "+
+				"(pull first, or use -force)", branchName, branchName)
+		}
+	}
+	reason := "push"
+	if *force {
+		reason = "push (forced)"
+	}
+	err = lock.commit(local, reason)
+	checkError(err)
+	checkError(writeRef("refs/remotes/"+*name+"/"+branchName, local, "push "+flags.Arg(0)))
+	fmt.Printf("%s -> %s\n", branchName, local)
+	pushTags(dst, *force)
+}
+
+func pushTags(dst string, force bool) {
+	copied, err := transferTags(".cap", dst, force, "push")
+	checkError(err)
+	if copied > 0 {
+		fmt.Printf("sent %d objects for tags\n", copied)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Hash prefixes shorter than this are too likely to be ambiguous
+const minHashPrefix = 4
+
+//Turn a revision named on the command line into a commit hash.
+//A revision is a name followed by any number of suffixes:
+//
+//	HEAD                 the current commit
+//	<branch>, <tag>      e.g. main, v1.0 (also refs/heads/main etc.)
+//	<remote>/<branch>    e.g. origin/main
+//	<hash prefix>        at least 4 hex digits, naming a unique commit
+//	<ref>@{<n>}          what ref (HEAD if left out) pointed at n
+//	                     changes ago, from its reflog
+//	<rev>~<n>            the nth generation ancestor, following first
+//	                     parents (~ alone means ~1)
+//	<rev>^<n>            the nth parent of rev (^ alone means ^1)
+func resolveRevision(rev string) (string, error) {
+	end := strings.IndexAny(rev, "~^")
+	if end < 0 {
+		end = len(rev)
+	}
+	commit, err := resolveRevisionName(rev[:end])
+	if err != nil {
+		return "", err
+	}
+
+	for suffix := rev[end:]; suffix != ""; {
+		op := suffix[0]
+		suffix = suffix[1:]
+		digits := 0
+		for digits < len(suffix) && suffix[digits] >= '0' && suffix[digits] <= '9' {
+			digits++
+		}
+		n := 1
+		if digits > 0 {
+			n, err = strconv.Atoi(suffix[:digits])
+			if err != nil {
+				return "", fmt.Errorf("invalid revision %s", rev)
+			}
+		}
+		suffix = suffix[digits:]
+
+		switch {
+		case op == '~':
+			for i := 0; i < n; i++ {
+				commit, err = parentOf(commit, 1, rev)
+				if err != nil {
+					return "", err
+				}
+			}
+		case n > 0:
+			commit, err = parentOf(commit, n, rev)
+			if err != nil {
+				return "", err
+			}
+		}
+		//<rev>^0 is the commit itself
+	}
+	return commit, nil
+}
+
+//The nth (1-based) parent of commit
+func parentOf(commit string, n int, rev string) (string, error) {
+	c, err := readCommit(commit)
+	if err != nil {
+		return "", err
+	}
+	if len(c.Parents) == 0 {
+		return "", fmt.Errorf("%s: history does not go back that far", rev)
+	}
+	if n > len(c.Parents) {
+		return "", fmt.Errorf("%s: commit %s has only %d parent(s)", rev, commit, len(c.Parents))
+	}
+	return c.Parents[n-1], nil
+}
+
+//Resolve a revision name without suffixes, trying refs before hashes
+func resolveRevisionName(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("empty revision")
+	}
+	if commit, found, err := resolveReflogRevision(name); found {
+		return commit, err
+	}
+	if name == "HEAD" {
+		commit, err := readCurrentCommit()
+		if err == nil && commit == "" {
+			err = fmt.Errorf("HEAD has no commits yet")
+		}
+		return commit, err
+	}
+	if checkRefName(name) == nil {
+		for _, ref := range []string{name, "refs/" + name, "refs/tags/" + name,
+			"refs/heads/" + name, "refs/remotes/" + name} {
+			if !strings.HasPrefix(ref, "refs/") || !refExists(ref) {
+				continue
+			}
+			commit, err := readRef(ref)
+			if err != nil {
+				return "", err
+			}
+			if commit == "" {
+				return "", fmt.Errorf("%s has no commits yet", name)
+			}
+			//Annotated tags point at a tag object
+			return peelToCommit(commit)
+		}
+	}
+	return resolveHashPrefix(name)
+}
+
+//Find the single commit (or annotated tag) whose hash starts with prefix
+func resolveHashPrefix(prefix string) (string, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < minHashPrefix || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("unknown revision %s", prefix)
+	}
+	candidates, err := objectsWithPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	commits := []string{}
+	for _, hash := range candidates {
+		if isObjectType(".cap", hash, typeCommit) || isObjectType(".cap", hash, typeTag) {
+			commits = append(commits, hash)
+		}
+	}
+	switch len(commits) {
+	case 0:
+		return "", fmt.Errorf("unknown revision %s", prefix)
+	case 1:
+		return peelToCommit(commits[0])
+	}
+	lines := []string{}
+	for _, hash := range commits {
+		if t, err := readTagIn(".cap", hash); err == nil {
+			lines = append(lines, hash+" tag "+t.Name)
+			continue
+		}
+		c, err := readCommit(hash)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, hash+" "+firstLine(c.Message))
+	}
+	return "", fmt.Errorf("%s is ambiguous; candidates are:\n\t%s", prefix, strings.Join(lines, "\n\t"))
+}
+
+//List stored objects, loose or packed, whose hash starts with prefix
+//(at least 2 characters)
+func objectsWithPrefix(prefix string) ([]string, error) {
+	found := map[string]bool{}
+	infos, err := ioutil.ReadDir(filepath.Join(".cap", "objects", prefix[:2]))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), prefix[2:]) && !strings.HasPrefix(info.Name(), ".") {
+			found[prefix[:2]+info.Name()] = true
+		}
+	}
+	packs, err := packsIn(".cap")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packs {
+		for hash := range p.objects {
+			if strings.HasPrefix(hash, prefix) {
+				found[hash] = true
+			}
+		}
+	}
+	hashes := []string{}
+	for hash := range found {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
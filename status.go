@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//Status codes, as used in the porcelain format
+const (
+	statusUnchanged = ' '
+	statusModified  = 'M'
+	statusAdded     = 'A'
+	statusDeleted   = 'D'
+	statusConflict  = 'U'
+)
+
+//How one path differs between the current commit, the index and the
+//working directory. Staged compares the index with the commit and
+//Unstaged compares the working directory with the index.
+type fileStatus struct {
+	Path      string
+	Staged    byte
+	Unstaged  byte
+	Untracked bool
+}
+
+//cap status [--porcelain]
+//Lists changes staged for the next commit, changes not yet staged, and
+//untracked files. --porcelain prints one "XY path" line per file, where
+//X is the staged status and Y the unstaged one ("??" for untracked).
+func status() {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	porcelain := flags.Bool("porcelain", false, "print a short, stable format for scripts")
+	parseFlags(flags, os.Args[2:])
+
+	statuses, err := worktreeStatus()
+	checkError(err)
+	if *porcelain {
+		for _, s := range statuses {
+			if s.Untracked {
+				fmt.Printf("?? %s\n", s.Path)
+			} else {
+				fmt.Printf("%c%c %s\n", s.Staged, s.Unstaged, s.Path)
+			}
+		}
+		return
+	}
+
+	if head, err := readHead(); err == nil && isDetached(head) {
+		fmt.Printf("HEAD detached at %s\n", head)
+	} else if name, err := currentBranch(); err == nil {
+		fmt.Printf("On branch %s\n", name)
+	}
+	if commit, err := readCurrentCommit(); err == nil && commit == "" {
+		fmt.Println("\nNo commits yet")
+	}
+	if mergeInProgress() {
+		fmt.Println("You are in the middle of a merge; `cap commit` to finish it.")
+	}
+	printStatusSection("Unmerged paths:", statuses, func(s fileStatus) byte {
+		if s.Staged == statusConflict {
+			return statusConflict
+		}
+		return statusUnchanged
+	})
+	printStatusSection("Changes to be committed:", statuses, func(s fileStatus) byte {
+		if s.Staged == statusConflict {
+			return statusUnchanged
+		}
+		return s.Staged
+	})
+	printStatusSection("Changes not staged for commit:", statuses, func(s fileStatus) byte {
+		if s.Unstaged == statusConflict {
+			return statusUnchanged
+		}
+		return s.Unstaged
+	})
+	untracked := false
+	for _, s := range statuses {
+		if !s.Untracked {
+			continue
+		}
+		if !untracked {
+			fmt.Println("\nUntracked files:")
+			untracked = true
+		}
+		fmt.Printf("\t%s\n", s.Path)
+	}
+	if len(statuses) == 0 {
+		fmt.Println("nothing to commit, working directory clean")
+	}
+}
+
+func printStatusSection(title string, statuses []fileStatus, code func(fileStatus) byte) {
+	labels := map[byte]string{
+		statusModified: "modified:",
+		statusAdded:    "new file:",
+		statusDeleted:  "deleted: ",
+		statusConflict: "conflict:",
+	}
+	printed := false
+	for _, s := range statuses {
+		c := code(s)
+		if s.Untracked || c == statusUnchanged {
+			continue
+		}
+		if !printed {
+			fmt.Println()
+			fmt.Println(title)
+			printed = true
+		}
+		fmt.Printf("\t%s %s\n", labels[c], s.Path)
+	}
+}
+
+//Compare the current commit, the index and the working directory,
+//returning every path that differs anywhere, sorted by path
+func worktreeStatus() ([]fileStatus, error) {
+	commit, err := readCurrentCommit()
+	if err != nil {
+		return nil, err
+	}
+	committed, err := commitFiles(commit)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	//Only staged files' contents are compared with anything
+	working, err := scanWorkingTree(idx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]bool{}
+	for _, files := range []map[string]treeEntry{committed, working} {
+		for path := range files {
+			paths[path] = true
+		}
+	}
+	for path := range idx {
+		paths[path] = true
+	}
+
+	statuses := []fileStatus{}
+	for path := range paths {
+		s := fileStatus{Path: path, Staged: statusUnchanged, Unstaged: statusUnchanged}
+		head, inHead := committed[path]
+		staged, inIndex := idx[path]
+		file, onDisk := working[path]
+		stagedEntry := treeEntry{Mode: staged.Mode, Hash: staged.Hash}
+
+		switch {
+		case !inIndex && !inHead:
+			s.Untracked = true
+		case !inIndex:
+			s.Staged = statusDeleted
+		case !inHead:
+			s.Staged = statusAdded
+		case !sameContent(head, stagedEntry):
+			s.Staged = statusModified
+		}
+		if inIndex && staged.Conflict {
+			s.Staged, s.Unstaged = statusConflict, statusConflict
+		} else if inIndex {
+			if !onDisk {
+				s.Unstaged = statusDeleted
+			} else if !sameContent(file, stagedEntry) {
+				s.Unstaged = statusModified
+			}
+		}
+		if s.Untracked || s.Staged != statusUnchanged || s.Unstaged != statusUnchanged {
+			statuses = append(statuses, s)
+		}
+		if !inIndex && inHead && onDisk {
+			//Unstaged with `cap rm --cached` but still on disk
+			statuses = append(statuses, fileStatus{Path: path, Untracked: true})
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].Path != statuses[j].Path {
+			return statuses[i].Path < statuses[j].Path
+		}
+		return !statuses[i].Untracked
+	})
+	return statuses, nil
+}
+
+//List every file in the working directory (skipping .cap), hashing
+//those that are staged or in tracked. Files whose size and mtime
+//match their index entry are assumed unchanged and take the staged hash
+//without being read. Untracked files are only listed, with no hash, as
+//nothing compares their contents.
+func scanWorkingTree(idx index, tracked map[string]treeEntry) (map[string]treeEntry, error) {
+	files := map[string]treeEntry{}
+	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == ".cap" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		path = filepath.ToSlash(path)
+		if staged, ok := idx.unchanged(path, info); ok {
+			files[path] = treeEntry{Name: info.Name(), Mode: staged.Mode, Hash: staged.Hash}
+			return nil
+		}
+		_, staged := idx[path]
+		if _, ok := tracked[path]; !staged && !ok {
+			files[path] = treeEntry{Name: info.Name()}
+			return nil
+		}
+		entry, err := hashWorkingFile(path)
+		if err != nil {
+			return err
+		}
+		files[path] = entry
+		return nil
+	})
+	return files, err
+}
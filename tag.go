@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Version of the tag encoding written by encodeTag
+const tagVersion = 1
+
+//An annotated tag as stored in .cap/objects: a named, signed-off
+//pointer to another object (usually a commit)
+type tagObject struct {
+	Version int
+	Object  string
+	Type    string
+	Name    string
+	Tagger  identity
+	Message string
+	//When the tag was made, in the tagger's timezone
+	Time time.Time
+}
+
+//Tags are stored as text with a fixed field order, like commits:
+//
+//	version 1
+//	object <hash>
+//	type <type of the tagged object>
+//	tag <name>
+//	tagger <name> <<email>>
+//	timestamp <RFC 3339, UTC>
+//	timezone <+hhmm offset the tag was made in>
+//
+//	<message>
+func encodeTag(t tagObject) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "version %d\n", t.Version)
+	fmt.Fprintf(&buf, "object %s\n", t.Object)
+	fmt.Fprintf(&buf, "type %s\n", t.Type)
+	fmt.Fprintf(&buf, "tag %s\n", t.Name)
+	fmt.Fprintf(&buf, "tagger %s\n", t.Tagger)
+	fmt.Fprintf(&buf, "timestamp %s\n", t.Time.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "timezone %s\n", t.Time.Format("-0700"))
+	buf.WriteString("\n")
+	buf.WriteString(t.Message)
+	return buf.Bytes()
+}
+
+//Parse a stored tag, checking that encoding it again reproduces the
+//hash it was stored under
+func decodeTag(hash string, content []byte) (tagObject, error) {
+	var t tagObject
+	fail := func(problem string) (tagObject, error) {
+		return tagObject{}, fmt.Errorf("tag %s: %s", hash, problem)
+	}
+	end := bytes.Index(content, []byte("\n\n"))
+	if end < 0 {
+		return fail("missing message")
+	}
+	t.Message = string(content[end+2:])
+
+	var timestamp, timezone string
+	for _, line := range strings.Split(string(content[:end]), "\n") {
+		space := strings.IndexByte(line, ' ')
+		if space < 0 {
+			return fail("malformed line " + strconv.Quote(line))
+		}
+		key, value := line[:space], line[space+1:]
+		switch key {
+		case "version":
+			version, err := strconv.Atoi(value)
+			if err != nil {
+				return fail("malformed version")
+			}
+			t.Version = version
+		case "object":
+			t.Object = value
+		case "type":
+			t.Type = value
+		case "tag":
+			t.Name = value
+		case "tagger":
+			id, err := parseIdentity(value)
+			if err != nil {
+				return fail(err.Error())
+			}
+			t.Tagger = id
+		case "timestamp":
+			timestamp = value
+		case "timezone":
+			timezone = value
+		default:
+			return fail("unknown field " + key)
+		}
+	}
+	if t.Version != tagVersion {
+		return fail(fmt.Sprintf("unsupported version %d", t.Version))
+	}
+
+	when, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return fail("malformed timestamp")
+	}
+	zone, err := time.Parse("-0700", timezone)
+	if err != nil {
+		return fail("malformed timezone")
+	}
+	t.Time = when.In(zone.Location())
+
+	if hashObject(typeTag, encodeTag(t)) != hash {
+		return fail("does not re-encode to its hash")
+	}
+	return t, nil
+}
+
+//Read and verify a tag from the given .cap directory
+func readTagIn(capDir, hash string) (tagObject, error) {
+	content, err := readTypedObjectIn(capDir, hash, typeTag)
+	if err != nil {
+		return tagObject{}, err
+	}
+	return decodeTag(hash, content)
+}
+
+//Follow annotated tags until reaching a commit
+func peelToCommit(hash string) (string, error) {
+	for {
+		kind, content, err := readObject(hash)
+		if err != nil {
+			return "", err
+		}
+		switch kind {
+		case typeCommit:
+			return hash, nil
+		case typeTag:
+			t, err := decodeTag(hash, content)
+			if err != nil {
+				return "", err
+			}
+			hash = t.Object
+		default:
+			return "", fmt.Errorf("%s is a %s, not a commit", hash, kind)
+		}
+	}
+}
+
+//cap tag [-l [<pattern>]]                        list tags, optionally
+//                                                matching a glob
+//cap tag <name> [<rev>]                          lightweight tag
+//cap tag -a -m <message> <name> [<rev>]          annotated tag
+//cap tag -d <name>                               delete a tag
+//Tags are refs under .cap/refs/tags holding either a commit hash
+//(lightweight) or the hash of a tag object (annotated).
+func tag() {
+	flags := flag.NewFlagSet("tag", flag.ExitOnError)
+	list := flags.Bool("l", false, "list tags matching an optional glob pattern")
+	annotate := flags.Bool("a", false, "make an annotated tag object")
+	message := flags.String("m", "", "message for an annotated tag (implies -a)")
+	del := flags.Bool("d", false, "delete the named tag")
+	force := flags.Bool("f", false, "replace an existing tag")
+	parseFlags(flags, os.Args[2:])
+
+	switch {
+	case *del:
+		if flags.NArg() != 1 {
+			log.Fatal("usage: cap tag -d <name>")
+		}
+		checkError(checkRefName(flags.Arg(0)))
+		ref := "refs/tags/" + flags.Arg(0)
+		if !refExists(ref) {
+			log.Fatalf("tag %s does not exist", flags.Arg(0))
+		}
+		checkError(os.Remove(filepath.Join(".cap", ref)))
+		checkError(removeReflog(ref))
+	case *list || flags.NArg() == 0:
+		if flags.NArg() > 1 {
+			log.Fatal("usage: cap tag -l [<pattern>]")
+		}
+		listTags(flags.Arg(0))
+	case flags.NArg() <= 2:
+		createTag(flags.Arg(0), flags.Arg(1), *annotate || *message != "", *message, *force)
+	default:
+		log.Fatal("usage: cap tag [-a -m <message>] [-f] <name> [<rev>]")
+	}
+}
+
+func listTags(pattern string) {
+	names, err := listRefs("refs/tags")
+	checkError(err)
+	for _, name := range names {
+		if pattern != "" {
+			matched, err := path.Match(pattern, name)
+			checkError(err)
+			if !matched {
+				continue
+			}
+		}
+		fmt.Println(name)
+	}
+}
+
+func createTag(name, rev string, annotated bool, message string, force bool) {
+	checkError(checkRefName(name))
+	ref := "refs/tags/" + name
+	if refExists(ref) && !force {
+		log.Fatalf("tag %s already exists (use -f to replace it)", name)
+	}
+	if rev == "" {
+		rev = "HEAD"
+	}
+	commit, err := resolveRevision(rev)
+	checkError(err)
+	var t *tagObject
+	if annotated {
+		if message == "" {
+			log.Fatal("annotated tags need a message (-m)")
+		}
+		tagger, err := lookupIdentity("committer")
+		checkError(err)
+		t = &tagObject{
+			Version: tagVersion,
+			Object:  commit,
+			Type:    typeCommit,
+			Name:    name,
+			Tagger:  tagger,
+			Message: message,
+			Time:    time.Now().Truncate(time.Second),
+		}
+	}
+	//Hold the gc lock so a tag object isn't swept before the ref points
+	//at it
+	lock, err := lockObjects()
+	checkError(err)
+	err = saveTag(ref, commit, t, "tag: "+rev)
+	lock.abort()
+	checkError(err)
+}
+
+//Point a tag ref at target, or at a new tag object if t is set
+func saveTag(ref, target string, t *tagObject, reason string) error {
+	if t != nil {
+		var err error
+		target, err = writeObject(typeTag, encodeTag(*t))
+		if err != nil {
+			return err
+		}
+	}
+	return writeRef(ref, target, reason)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//Modes recorded for tree entries. These follow git's conventions so
+//they are easy to recognise when reading a tree object by hand.
+const (
+	modeFile       = "100644"
+	modeExecutable = "100755"
+	modeSymlink    = "120000"
+	modeTree       = "040000"
+)
+
+//A single file or subdirectory recorded in a tree object
+type treeEntry struct {
+	Name string `json:"name"`
+	Mode string `json:"mode"`
+	Hash string `json:"hash"`
+}
+
+func (e treeEntry) isTree() bool {
+	return e.Mode == modeTree
+}
+
+//Store a snapshot given as slash-separated paths mapped to their
+//entries (e.g. the index), returning the hash of the root tree
+//1. Group the paths by their first component
+//2. Save each subdirectory as a tree (recursively)
+//3. Sort the entries by name so the tree hash is stable
+//4. Store the tree JSON as a tree object
+func writeTree(files map[string]treeEntry) (string, error) {
+	entries := []treeEntry{}
+	subdirs := map[string]map[string]treeEntry{}
+	for path, entry := range files {
+		slash := strings.IndexByte(path, '/')
+		if slash < 0 {
+			entry.Name = path
+			entries = append(entries, entry)
+			continue
+		}
+		dir := path[:slash]
+		if subdirs[dir] == nil {
+			subdirs[dir] = map[string]treeEntry{}
+		}
+		subdirs[dir][path[slash+1:]] = entry
+	}
+	for _, entry := range entries {
+		if _, ok := subdirs[entry.Name]; ok {
+			return "", fmt.Errorf("%s is both a file and a directory", entry.Name)
+		}
+	}
+	for dir, subfiles := range subdirs {
+		hash, err := writeTree(subfiles)
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, treeEntry{Name: dir, Mode: modeTree, Hash: hash})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	treeContent, err := json.Marshal(entries)
+	if err != nil {
+		return "", err
+	}
+	return writeObject(typeTree, treeContent)
+}
+
+//Read the entries of a stored tree object
+func readTree(hash string) ([]treeEntry, error) {
+	var entries []treeEntry
+	err := readJSONObject(hash, typeTree, &entries)
+	return entries, err
+}
+
+//Flatten a tree into a map of slash-separated paths to their entries,
+//leaving out the subtrees themselves
+func flattenTree(hash, prefix string, files map[string]treeEntry) error {
+	entries, err := readTree(hash)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := prefix + entry.Name
+		if entry.isTree() {
+			err = flattenTree(entry.Hash, path+"/", files)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		files[path] = entry
+	}
+	return nil
+}
+
+func fileMode(info os.FileInfo) string {
+	if info.Mode()&0111 != 0 {
+		return modeExecutable
+	}
+	return modeFile
+}
+
+//Read the contents of a stored blob
+func readBlob(hash string) ([]byte, error) {
+	return readTypedObjectIn(".cap", hash, typeBlob)
+}
+
+//Open a stored blob to stream its contents
+func openBlob(hash string) (io.ReadCloser, error) {
+	kind, _, content, err := openObjectIn(".cap", hash)
+	if err == nil && kind != typeBlob {
+		content.Close()
+		err = fmt.Errorf("object %s is a %s, not a %s", hash, kind, typeBlob)
+	}
+	return content, err
+}
+
+//Read a file in the working directory as it would be stored: the
+//contents of a regular file or the target of a symlink. Anything else
+//(e.g. a directory) has no contents and an empty mode.
+func readWorkingFile(path string) (string, []byte, os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		return modeSymlink, []byte(target), info, err
+	case info.Mode().IsRegular():
+		bytes, err := ioutil.ReadFile(path)
+		return fileMode(info), bytes, info, err
+	}
+	return "", nil, info, nil
+}
+
+//Hash a file in the working directory the same way it would be stored,
+//without storing anything. Returns the entry for the path, or an
+//error satisfying os.IsNotExist if there is nothing there. Directories
+//and other special files come back with modeTree and no hash.
+func hashWorkingFile(path string) (treeEntry, error) {
+	entry, _, err := workingBlob(path, false)
+	if err == nil && entry.Mode == "" {
+		entry.Mode = modeTree
+	}
+	return entry, err
+}
+
+//Store a file in the working directory as a blob, returning its entry
+//and what it looked like when read. Special files come back with an
+//empty mode and are not stored.
+func storeWorkingFile(path string) (treeEntry, os.FileInfo, error) {
+	return workingBlob(path, true)
+}
+
+//Hash (and if store is set, store) a working file as a blob. Regular
+//files are streamed rather than read into memory, however large.
+func workingBlob(path string, store bool) (treeEntry, os.FileInfo, error) {
+	entry := treeEntry{Name: filepath.Base(path)}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return entry, nil, err
+	}
+	var r io.Reader
+	size := info.Size()
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return entry, info, err
+		}
+		entry.Mode = modeSymlink
+		r, size = strings.NewReader(target), int64(len(target))
+	case info.Mode().IsRegular():
+		file, err := os.Open(path)
+		if err != nil {
+			return entry, info, err
+		}
+		defer file.Close()
+		entry.Mode = fileMode(info)
+		r = file
+	default:
+		return entry, info, nil
+	}
+	if store {
+		entry.Hash, err = writeObjectFrom(".cap", typeBlob, r, size)
+	} else {
+		entry.Hash, err = hashObjectFrom(typeBlob, r, size)
+	}
+	if err != nil {
+		return entry, info, fmt.Errorf("%s: %v", path, err)
+	}
+	return entry, info, nil
+}